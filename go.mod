@@ -5,16 +5,17 @@ go 1.17
 require (
 	github.com/GeertJohan/yubigo v0.0.0-20190917122436-175bc097e60e
 	github.com/boombuler/barcode v1.0.1 // indirect
+	github.com/nmcclain/asn1-ber v0.0.0-20170104154839-2661553a0484
 	github.com/nmcclain/ldap v0.0.0-20210720162743-7f8d1e44eeba
 	github.com/pquerna/otp v1.3.0
 	github.com/yaegashi/msgraph.go v0.1.4
 	golang.org/x/crypto v0.0.0-20211202192323-5770296d904e
+	golang.org/x/sys v0.10.0
 )
 
 require go.uber.org/zap v1.19.1
 
 require (
-	github.com/nmcclain/asn1-ber v0.0.0-20170104154839-2661553a0484 // indirect
 	github.com/rickb777/date v1.16.1 // indirect
 	github.com/rickb777/plural v1.4.1 // indirect
 	go.uber.org/atomic v1.9.0 // indirect
@@ -16,6 +16,108 @@ type Backend struct {
 	PluginHandler string // Name of plugin's main handler function
 	Database      string // For Database backends only
 	AnonymousDSE  bool   // For Config and Database backends only
+	MemoryUsers   int    // Number of synthetic users, for memory backend only
+	MemoryGroups  int    // Number of synthetic groups, for memory backend only
+	ReplayFile    string // Recording of operations served, for replay backend only
+	// How client connections are mapped to backend sessions: "address" (default) or "connection"
+	SessionIdentity string // For LDAP and owncloud backend only
+	// Allow a non-empty bind DN with an empty password to be forwarded (RFC 4513 unauthenticated bind)
+	AllowUnauthenticatedBind bool // For LDAP backend only
+	// Validate the certificate chain but not the hostname, e.g. for servers reached by IP address
+	SkipHostnameVerification bool   // For LDAP backend only
+	LocalAddr                string // Source IP for backend connections, for ldaps servers of the LDAP backend only
+	WriteReferral            string // LDAP URL of the master; Add/Modify/Delete then get referral (10), without the URL, which the LDAP library cannot send
+	HomedirTemplate          string // e.g. /home/{group}/{username}, for config backend only
+	LoginShellTemplate       string // e.g. /bin/bash, for config backend only
+	SortEntries              bool   // Return entries ordered by DN, for config backend only
+	StartupPingAttempts      int    // Pings before giving up on unreachable servers at startup, default 1
+	StartupPingInterval      int    // Seconds between startup pings, for LDAP backend only
+	// Rewrite values of returned attributes, e.g. lowercase mail; for LDAP and config backends
+	AttributeTransforms []AttributeTransform
+	Name                string // Identifies the backend, e.g. in users' AuthBackend
+	EmptyBaseDN         string // Searches with an empty base, root DSE aside: "default" searches BaseDN, "reject" refuses them
+	MaxResponseEntries  int    // Entries accepted from the upstream server per search, 0 for unlimited; for LDAP backend only
+	MaxResponseBytes    int    // Approximate size accepted from the upstream server per search, 0 for unlimited; for LDAP backend only
+	DegradedSearch      string // Answer to searches when no server can be reached: "error" (default), "unavailable" or "empty"
+	GecosTemplate       string // e.g. "{givenname} {sn},{office},{phone}" with custom attributes, for config backend only
+	// Domains of the user@domain bind names routed to this backend, and the DN presented for
+	// such names, e.g. "uid={user},ou=people,dc=eng,dc=com"; {upn} and {domain} also apply
+	UPNSuffixes    []string
+	BindDNTemplate string
+	// How much, in percent, the "weight" of server URLs counts against their observed
+	// latency when picking a server: 0 (default) only looks at latency, 100 only at weights
+	WeightBlend int
+	// DNS name of SRV records listing the servers instead of Servers, e.g. "_ldaps._tcp.example.com",
+	// looked up again every SRVRefresh seconds (default 300); for LDAP backend only
+	ServersSRV string
+	SRVRefresh int
+	// OIDs of the search controls passed on to the upstream server, all when empty; others
+	// are dropped, or fail the search when critical. For LDAP backend only
+	ForwardedControls []string
+	// Seconds during which a successful bind is answered again without asking the upstream
+	// server, when repeated with the same credentials on the same session; 0 (default) to disable
+	BindCacheTTL int
+	// Attributes added to every returned entry below BaseDN; for LDAP and config backends
+	FixedAttributes []FixedAttribute
+	BindTimeout     int // In seconds, bound on a whole bind, from user lookup to upstream answer; for LDAP backend only
+	// TLS settings of ldaps:// servers, and of ldap:// servers, which are upgraded with StartTLS
+	// only when StartTLS is set; for LDAP backend only
+	LDAPSTLS *BackendTLS
+	StartTLS *BackendTLS
+	// Result codes of failed upstream binds and searches replaced before reaching clients;
+	// for LDAP backend only
+	ResultCodeMappings []ResultCodeMapping
+	// Bind names accepted besides DNs and user@domain: "bare" (jdoe) and "domain" (CORP\jdoe)
+	BindNameForms []string
+	// Idle connections kept open to the server next in line, so that failing over to it
+	// is immediate; 0 (default) to disable. For LDAP backend only
+	StandbyConnections int
+	// OID of a non-critical control carrying the client's IP address, added to the searches
+	// sent upstream; for LDAP backend only
+	ClientAddressControl string
+	// Entries returned twice under the same DN: "first" keeps the first occurrence, "merge" adds
+	// the values of the others to it; kept as they come by default. For LDAP and config backends
+	DeduplicateEntries string
+	// Binds whose password, once stripped of any OTP, is shorter are refused without contacting
+	// the upstream server; 0 (default) to disable. For LDAP backend only
+	MinPasswordLength int
+	// Searches whose base does not exist upstream: "empty" answers noSuchObject with an empty
+	// success, "nosuchobject" answers empty results under a missing base with noSuchObject;
+	// left as the upstream server answers by default. For LDAP backend only
+	MissingBaseDN string
+	// Times a bind or search answered busy or unavailable by the upstream server is tried again,
+	// 0 (default) for none, waiting BusyRetryBackoff milliseconds, doubled each time, in between.
+	// For LDAP backend only
+	BusyRetries      int
+	BusyRetryBackoff int
+	// Weight, between 0 and 1, of the latest ping in every server's smoothed success rate and
+	// latency; 0 (default) to go by the latest ping alone. For LDAP backend only
+	HealthSmoothing float64
+	// Smoothed success rate, between 0 and 1, below which a server is not used even though its
+	// latest ping succeeded; 0 (default) to use every server that is up. For LDAP backend only
+	HealthThreshold float64
+	// Binds with a DN that is neither a NameFormat RDN under BaseDN nor one of BindNameForms:
+	// "reject" (default) answers invalidCredentials, "invaliddn" invalidDNSyntax, "passthrough"
+	// sends it upstream as it is. WARNING: passed through names that do not resolve to a known
+	// user skip the OTP check, see README. For LDAP backend only
+	NonConformingBindDN string
+	// Name of a GidResolver, registered by a program compiling GLAuth in, from which group
+	// gidNumbers, and possibly members, are taken; for config backend only
+	GidResolver string
+	// In seconds, how long resolved groups are cached, defaults to 300
+	GidResolverTTL int
+	// Return an entryUUID, derived from the DN, with entries whose search asks for it; not for
+	// LDAP backend, whose upstream server has its own
+	EntryUUID bool
+	// Attributes an upstream entry carries more than once under the same name: "first" keeps the
+	// first occurrence, "merge" adds the values of the others to it; kept as they come by default.
+	// For LDAP backend only
+	DuplicateAttributes string
+	// How new sessions of a bound user pick their server: "hash" spreads users over the usable
+	// servers by DN, "last" reuses the server of the user's previous session for StickyUsersTTL
+	// seconds (default 300); the best server for every session by default. For LDAP backend only
+	StickyUsers    string
+	StickyUsersTTL int
 }
 type Helper struct {
 	Enabled       bool
@@ -33,14 +135,28 @@ type Frontend struct {
 	TLS            bool
 }
 type LDAP struct {
-	Enabled bool
-	Listen  string
+	Enabled   bool
+	Listen    string
+	Addresses []string // Additional listen addresses, e.g. for dual-stack
+	ReusePort bool     // Set SO_REUSEPORT, letting several processes share the port
 }
 type LDAPS struct {
-	Enabled bool
-	Listen  string
-	Cert    string
-	Key     string
+	Enabled   bool
+	Listen    string
+	Addresses []string // Additional listen addresses, e.g. for dual-stack
+	ReusePort bool     // Set SO_REUSEPORT, letting several processes share the port
+	Cert      string
+	Key       string
+	ClientCA  string // PEM file of the CAs verifying client certificates, which are then logged and passed to hooks
+	// Additional certificate/key pairs, presented to clients asking for one of the names
+	// they are issued to through SNI; Cert and Key remain the default
+	Certificates []TLSCertificate
+}
+
+// TLSCertificate is a certificate/key pair, in PEM files
+type TLSCertificate struct {
+	Cert string
+	Key  string
 }
 type API struct {
 	Cert        string
@@ -51,6 +167,14 @@ type API struct {
 	SecretToken string
 	TLS         bool
 }
+type StatsD struct {
+	Enabled       bool
+	Address       string
+	Network       string // "udp" (default) or "tcp"
+	Prefix        string
+	Tags          []string      // DogStatsD tags, as "key:value"
+	FlushInterval time.Duration // In seconds, defaults to 10
+}
 type Behaviors struct {
 	IgnoreCapabilities    bool
 	LimitFailedBinds      bool
@@ -59,6 +183,76 @@ type Behaviors struct {
 	BlockFailedBindsFor   time.Duration
 	PruneSourceTableEvery time.Duration
 	PruneSourcesOlderThan time.Duration
+	EntryQuota            int           // Maximum number of entries returned to one bound identity per window, 0 for unlimited
+	EntryQuotaWindow      time.Duration // In seconds, defaults to 60
+	MaxRequestSize        int           // In bytes, requests encoded in more end their connection, 0 for unlimited
+	MaxTimeLimit          time.Duration // In seconds, upper bound for backend searches, also used when the client sets none
+	MaintenanceResultCode int           // Result code returned to binds in maintenance mode, defaults to unavailable (52)
+	MaintenanceMessage    string        // Logged for binds refused in maintenance mode; bind responses carry no diagnostic text
+	MaintenanceSignal     bool          // Toggle maintenance mode on SIGUSR1
+	AcceptLDAPv2          bool          // Serve binds of legacy LDAPv2 clients as LDAPv3 ones, see README
+	FailedBindDelay       int           // In milliseconds, delay before answering a failed bind, doubled with each recent failure; 0 to disable
+	FailedBindDelayMax    int           // In milliseconds, upper bound of the failed bind delay, defaults to 5000
+	ReportMissingOTP      bool          // Log and count binds that failed for lack of an OTP apart from wrong ones, see README
+	ReadOnly              bool          // Refuse every add, modify and delete, whatever the backends allow
+	ReadOnlyResultCode    int           // Result code of writes refused in read-only mode, defaults to insufficient access rights (50)
+	OTPWindowsBefore      int           // Past 30s TOTP windows accepted; with OTPWindowsAfter 0 as well, one each way; negative for none
+	OTPWindowsAfter       int           // Future 30s TOTP windows accepted; negative for none
+	MaxFilterDepth        int           // Nesting of and/or/not beyond which searches are refused, 0 for unlimited
+	MaxFilterTerms        int           // Assertions in a filter beyond which searches are refused, 0 for unlimited
+	RecordFile            string        // Append every operation and its response to this file, for the replay backend; for tests only
+	RootDSE               string        // Name of the backend answering root DSE queries, or "aggregate" to merge every backend's answer
+	OTPErrorsFailOpen     bool          // Let binds through without OTP when none of the user's OTP secrets can be decoded
+	ClientReadTimeout     time.Duration // In seconds, clients silent for longer, e.g. between operations, are disconnected; 0 for none
+	ClientWriteTimeout    time.Duration // In seconds, clients not reading their responses for longer are disconnected; 0 for none
+	AlwaysReturned        []string      // Attributes added to every entry returned by searches listing the attributes they want
+	OTPGracePeriod        time.Duration // In hours after a user's OTPEnrolled, binds lacking a required OTP are still accepted; 0 for none
+}
+type Hooks struct {
+	PreBindURL      string        // Webhook consulted before every bind
+	PreBindTimeout  time.Duration // In seconds, defaults to 5
+	PreBindFailOpen bool          // Allow the bind when the webhook cannot be reached
+	PostBindURL     string        // Webhook notified, asynchronously, of every bind outcome
+	PostBindFile    string        // File to which bind outcomes are appended as JSON lines
+	PostBindBuffer  int           // Number of pending post-bind events kept before dropping, defaults to 1000
+}
+
+// AttributeTransform rewrites the values of one attribute of returned entries.
+// Template may refer to {value} and to the first value of any attribute, e.g. {uid}@example.com
+type AttributeTransform struct {
+	Attribute string
+	Template  string // default {value}; an absent attribute is added when the template yields a value
+	Case      string // "lower", "upper" or empty to keep as is
+}
+
+// BackendTLS holds the TLS settings used to reach upstream servers, in addition to the
+// backend-wide Insecure and SkipHostnameVerification
+type BackendTLS struct {
+	CACert                   string // PEM file of the CAs trusted, instead of the system ones
+	Cert                     string // PEM client certificate presented to the servers
+	Key                      string
+	Insecure                 bool
+	SkipHostnameVerification bool
+}
+
+// ResultCodeMapping replaces an upstream result code, e.g. 11 (adminLimitExceeded) with 4 (sizeLimitExceeded)
+type ResultCodeMapping struct {
+	From int
+	To   int
+}
+
+// FixedAttribute is added to returned entries, its values merged with any the entry has
+type FixedAttribute struct {
+	Name   string
+	Values []string
+}
+type Routing struct {
+	Routes         []Route
+	DefaultBackend int // Position of the backend serving identities no route matches, defaults to the first
+}
+type Route struct {
+	Pattern string // Regular expression matched against the user name, the first RDN value of the DN
+	Backend int    // Position of the backend in Backends
 }
 type Capability struct {
 	Action string
@@ -75,6 +269,9 @@ type User struct {
 	Capabilities  []Capability
 	SSHKeys       []string
 	OTPSecret     string
+	OTPSecrets    []string  // Additional TOTP secrets, one per enrolled authenticator
+	OTPPolicy     string    // "required", "optional" or "disabled"; required of users with an OTP secret or Yubikey by default
+	OTPEnrolled   time.Time // When the user enrolled OTP, starting the grace period of Behaviors.OTPGracePeriod
 	Yubikey       string
 	Disabled      bool
 	UnixID        int // TODO: remove after deprecating UnixID on User and Group
@@ -85,12 +282,15 @@ type User struct {
 	SN            string
 	Homedir       string
 	CustomAttrs   map[string]interface{}
+	EntryQuota    int    // Overrides the global entry quota, -1 for unlimited
+	AuthBackend   string // Name of the backend authenticating this user, overriding routes
 }
 type Group struct {
 	Name          string
 	UnixID        int // TODO: remove after deprecating UnixID on User and Group
 	GIDNumber     int
 	IncludeGroups []int
+	EntryQuota    int // Entry quota of users whose primary group this is, -1 for unlimited
 }
 type Config struct {
 	API                API
@@ -98,6 +298,9 @@ type Config struct {
 	Backends           []Backend
 	Helper             Helper
 	Behaviors          Behaviors
+	Hooks              Hooks
+	Routing            Routing
+	StatsD             StatsD
 	Debug              bool
 	WatchConfig        bool
 	YubikeyClientID    string
@@ -113,3 +316,26 @@ type Config struct {
 	AwsSecretAccessKey string
 	AwsRegion          string
 }
+
+// ListenAddresses returns every address the LDAP listener should bind to
+func (l LDAP) ListenAddresses() []string {
+	return listenAddresses(l.Listen, l.Addresses)
+}
+
+// ListenAddresses returns every address the LDAPS listener should bind to
+func (l LDAPS) ListenAddresses() []string {
+	return listenAddresses(l.Listen, l.Addresses)
+}
+
+func listenAddresses(listen string, addresses []string) []string {
+	all := []string{}
+	if listen != "" {
+		all = append(all, listen)
+	}
+	for _, a := range addresses {
+		if a != "" && a != listen {
+			all = append(all, a)
+		}
+	}
+	return all
+}
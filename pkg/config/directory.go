@@ -0,0 +1,92 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Decoder parses a config fragment, e.g. toml.Unmarshal or json.Unmarshal
+type Decoder func(data []byte, v interface{}) error
+
+// LoadDirectory merges every fragment matching pattern in dir into c, in lexical
+// file name order. Only users, groups and backends are taken from fragments: they
+// are appended to the ones already in c. A user or group name, or a group GID,
+// defined twice is an error naming both sources. A nil decoder reads JSON.
+func (c *Config) LoadDirectory(dir string, pattern string, decode Decoder) error {
+	if decode == nil {
+		decode = json.Unmarshal
+	}
+	files, err := filepath.Glob(filepath.Join(dir, pattern))
+	if err != nil {
+		return err
+	}
+	sort.Strings(files)
+
+	origins := newFragmentOrigins(c, "main config")
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		var fragment Config
+		if err := decode(data, &fragment); err != nil {
+			return fmt.Errorf("%s: %s", file, err)
+		}
+		if err := origins.merge(c, fragment, file); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fragmentOrigins remembers where each user and group was defined, to report duplicates
+type fragmentOrigins struct {
+	users  map[string]string
+	groups map[string]string
+	gids   map[int]string
+}
+
+func newFragmentOrigins(c *Config, source string) fragmentOrigins {
+	o := fragmentOrigins{
+		users:  make(map[string]string),
+		groups: make(map[string]string),
+		gids:   make(map[int]string),
+	}
+	for _, u := range c.Users {
+		o.users[strings.ToLower(u.Name)] = source
+	}
+	for _, g := range c.Groups {
+		o.groups[strings.ToLower(g.Name)] = source
+		o.gids[g.GIDNumber] = source
+	}
+	return o
+}
+
+func (o fragmentOrigins) merge(c *Config, fragment Config, source string) error {
+	for _, u := range fragment.Users {
+		name := strings.ToLower(u.Name)
+		if prev, ok := o.users[name]; ok {
+			return fmt.Errorf("%s: user %s already defined in %s", source, u.Name, prev)
+		}
+		o.users[name] = source
+	}
+	for _, g := range fragment.Groups {
+		name := strings.ToLower(g.Name)
+		if prev, ok := o.groups[name]; ok {
+			return fmt.Errorf("%s: group %s already defined in %s", source, g.Name, prev)
+		}
+		if prev, ok := o.gids[g.GIDNumber]; ok {
+			return fmt.Errorf("%s: gidnumber %d of group %s already used in %s", source, g.GIDNumber, g.Name, prev)
+		}
+		o.groups[name] = source
+		o.gids[g.GIDNumber] = source
+	}
+	c.Users = append(c.Users, fragment.Users...)
+	c.Groups = append(c.Groups, fragment.Groups...)
+	c.Backends = append(c.Backends, fragment.Backends...)
+	return nil
+}
@@ -0,0 +1,80 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeFragments(t *testing.T, fragments map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for name, content := range fragments {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestLoadDirectoryOrder(t *testing.T) {
+	dir := writeFragments(t, map[string]string{
+		"20-bob.json":    `{"users": [{"name": "bob", "uidnumber": 5002}]}`,
+		"10-alice.json":  `{"users": [{"name": "alice", "uidnumber": 5001}], "groups": [{"name": "staff", "gidnumber": 6000}]}`,
+		"30-ldap.json":   `{"backends": [{"datastore": "ldap"}]}`,
+		"ignored.toml":   `not json`,
+		"15-carol.json":  `{"users": [{"name": "carol", "uidnumber": 5003}]}`,
+		"00-admins.json": `{"groups": [{"name": "admins", "gidnumber": 6001}]}`,
+	})
+	c := Config{Users: []User{{Name: "root", UIDNumber: 5000}}}
+	if err := c.LoadDirectory(dir, "*.json", nil); err != nil {
+		t.Fatal(err)
+	}
+	var users []string
+	for _, u := range c.Users {
+		users = append(users, u.Name)
+	}
+	// the main config comes first, then fragments in file name order
+	if strings.Join(users, ",") != "root,alice,carol,bob" {
+		t.Errorf("unexpected user order %v", users)
+	}
+	if len(c.Groups) != 2 || c.Groups[0].Name != "admins" || c.Groups[1].Name != "staff" {
+		t.Errorf("unexpected groups %v", c.Groups)
+	}
+	if len(c.Backends) != 1 || c.Backends[0].Datastore != "ldap" {
+		t.Errorf("unexpected backends %v", c.Backends)
+	}
+}
+
+func TestLoadDirectoryDuplicates(t *testing.T) {
+	for name, tc := range map[string]struct {
+		main      Config
+		fragments map[string]string
+		expected  string
+	}{
+		"user in main config": {
+			main:      Config{Users: []User{{Name: "Alice"}}},
+			fragments: map[string]string{"a.json": `{"users": [{"name": "alice"}]}`},
+			expected:  "user alice already defined in main config",
+		},
+		"user in two fragments": {
+			fragments: map[string]string{"a.json": `{"users": [{"name": "bob"}]}`, "b.json": `{"users": [{"name": "bob"}]}`},
+			expected:  "b.json: user bob already defined in",
+		},
+		"group name": {
+			fragments: map[string]string{"a.json": `{"groups": [{"name": "staff", "gidnumber": 1}]}`, "b.json": `{"groups": [{"name": "Staff", "gidnumber": 2}]}`},
+			expected:  "group Staff already defined",
+		},
+		"group number": {
+			fragments: map[string]string{"a.json": `{"groups": [{"name": "staff", "gidnumber": 1}]}`, "b.json": `{"groups": [{"name": "admins", "gidnumber": 1}]}`},
+			expected:  "gidnumber 1 of group admins already used",
+		},
+	} {
+		dir := writeFragments(t, tc.fragments)
+		err := tc.main.LoadDirectory(dir, "*.json", nil)
+		if err == nil || !strings.Contains(err.Error(), tc.expected) {
+			t.Errorf("%s: expected an error containing %q, got %v", name, tc.expected, err)
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package config
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// attributeType matches the attribute types of DNs: a descriptor or a numeric OID
+var attributeType = regexp.MustCompile(`^([A-Za-z][A-Za-z0-9-]*|[0-9]+(\.[0-9]+)*)$`)
+
+// CanonicalDN checks the syntax of a DN (RFC 4514) and returns it with attribute types in
+// lower case and the spaces around separators removed. Values keep their case and escapes:
+// GLAuth compares DNs without regard to case.
+func CanonicalDN(dn string) (string, error) {
+	rdns, err := splitDN(dn, ',')
+	if err != nil {
+		return "", err
+	}
+	for i, rdn := range rdns {
+		avas, err := splitDN(rdn, '+')
+		if err != nil {
+			return "", err
+		}
+		for j, ava := range avas {
+			eq := strings.Index(ava, "=")
+			if eq < 0 {
+				return "", fmt.Errorf("invalid DN %q: %q is not of the form type=value", dn, strings.TrimSpace(ava))
+			}
+			typ, value := strings.TrimSpace(ava[:eq]), trimValue(ava[eq+1:])
+			if !attributeType.MatchString(typ) {
+				return "", fmt.Errorf("invalid DN %q: invalid attribute type %q", dn, typ)
+			}
+			if value == "" {
+				return "", fmt.Errorf("invalid DN %q: empty value for %s", dn, typ)
+			}
+			avas[j] = strings.ToLower(typ) + "=" + value
+		}
+		rdns[i] = strings.Join(avas, "+")
+	}
+	return strings.Join(rdns, ","), nil
+}
+
+// splitDN splits s on the unescaped occurrences of sep, refusing empty parts and escapes
+// that are neither a special character nor two hex digits
+func splitDN(s string, sep byte) ([]string, error) {
+	var parts []string
+	start := 0
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			if i+1 >= len(s) {
+				return nil, fmt.Errorf("invalid DN %q: dangling escape", s)
+			}
+			if strings.IndexByte(" \"#+,;<=>\\", s[i+1]) < 0 {
+				if i+2 >= len(s) || !isHex(s[i+1]) || !isHex(s[i+2]) {
+					return nil, fmt.Errorf("invalid DN %q: invalid escape at position %d", s, i)
+				}
+				i++
+			}
+			i++
+		case sep:
+			if strings.TrimSpace(s[start:i]) == "" {
+				return nil, fmt.Errorf("invalid DN %q: empty RDN at position %d", s, i)
+			}
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	if strings.TrimSpace(s[start:]) == "" {
+		return nil, fmt.Errorf("invalid DN %q: empty RDN at the end", s)
+	}
+	return append(parts, s[start:]), nil
+}
+
+// trimValue removes the spaces around an attribute value, but not an escaped trailing one
+func trimValue(value string) string {
+	value = strings.TrimLeft(value, " ")
+	for strings.HasSuffix(value, " ") && !strings.HasSuffix(value, "\\ ") {
+		value = value[:len(value)-1]
+	}
+	return value
+}
+
+func isHex(c byte) bool {
+	return (c >= '0' && c <= '9') || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')
+}
+
+// CanonicalizeBaseDNs checks the BaseDN of every backend and of the helper, replacing each
+// with its canonical form, so that a malformed one is reported before anything is served
+func (c *Config) CanonicalizeBaseDNs() error {
+	for i := range c.Backends {
+		if c.Backends[i].BaseDN == "" {
+			continue
+		}
+		canonical, err := CanonicalDN(c.Backends[i].BaseDN)
+		if err != nil {
+			return fmt.Errorf("backend %d: basedn: %s", i, err)
+		}
+		c.Backends[i].BaseDN = canonical
+	}
+	if c.Helper.BaseDN != "" {
+		canonical, err := CanonicalDN(c.Helper.BaseDN)
+		if err != nil {
+			return fmt.Errorf("helper: basedn: %s", err)
+		}
+		c.Helper.BaseDN = canonical
+	}
+	return nil
+}
@@ -0,0 +1,27 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+)
+
+// OTP policies of users: whether binds must, may or must not end with a token
+const (
+	OTPRequired = "required"
+	OTPOptional = "optional"
+	OTPDisabled = "disabled"
+)
+
+// ValidateOTPPolicies checks the OTP policy of every user, and stores it in lower case
+func (c *Config) ValidateOTPPolicies() error {
+	for i := range c.Users {
+		policy := strings.ToLower(c.Users[i].OTPPolicy)
+		switch policy {
+		case "", OTPRequired, OTPOptional, OTPDisabled:
+			c.Users[i].OTPPolicy = policy
+		default:
+			return fmt.Errorf("Unknown OTP policy of user %s: %s - must be one of 'required', 'optional', 'disabled'", c.Users[i].Name, c.Users[i].OTPPolicy)
+		}
+	}
+	return nil
+}
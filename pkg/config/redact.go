@@ -0,0 +1,51 @@
+package config
+
+// redacted replaces secrets in introspection output
+const redacted = "********"
+
+// Redacted returns a copy of the config, safe to expose, in which password hashes,
+// OTP secrets, tokens, database connection strings and cloud credentials are masked
+func (c Config) Redacted() Config {
+	r := c
+	r.API.SecretToken = mask(c.API.SecretToken)
+	r.YubikeySecret = mask(c.YubikeySecret)
+	r.AwsSecretAccessKey = mask(c.AwsSecretAccessKey)
+	r.Backend.Database = mask(c.Backend.Database)
+	r.Helper.Database = mask(c.Helper.Database)
+
+	r.Backends = make([]Backend, len(c.Backends))
+	for i, b := range c.Backends {
+		b.Database = mask(b.Database)
+		r.Backends[i] = b
+	}
+
+	r.Users = make([]User, len(c.Users))
+	for i, u := range c.Users {
+		u.PassSHA256 = mask(u.PassSHA256)
+		u.PassBcrypt = mask(u.PassBcrypt)
+		u.PassAppSHA256 = maskAll(u.PassAppSHA256)
+		u.PassAppBcrypt = maskAll(u.PassAppBcrypt)
+		u.OTPSecret = mask(u.OTPSecret)
+		u.OTPSecrets = maskAll(u.OTPSecrets)
+		r.Users[i] = u
+	}
+	return r
+}
+
+func mask(secret string) string {
+	if secret == "" {
+		return ""
+	}
+	return redacted
+}
+
+func maskAll(secrets []string) []string {
+	if secrets == nil {
+		return nil
+	}
+	masked := make([]string, len(secrets))
+	for i, s := range secrets {
+		masked[i] = mask(s)
+	}
+	return masked
+}
@@ -0,0 +1,47 @@
+package handler
+
+import (
+	"errors"
+	"strings"
+
+	ber "github.com/nmcclain/asn1-ber"
+	"github.com/nmcclain/ldap"
+)
+
+// ControlTypeAssertion is the OID of the assertion control (RFC 4528)
+const ControlTypeAssertion = "1.3.6.1.1.12"
+
+// LDAPResultAssertionFailed is returned when the assertion control's filter does not match
+const LDAPResultAssertionFailed = ldap.LDAPResultCode(122)
+
+// assertionFilter decodes the filter of an assertion control, if any
+func assertionFilter(controls []ldap.Control) (*ber.Packet, error) {
+	control := ldap.FindControl(controls, ControlTypeAssertion)
+	if control == nil {
+		return nil, nil
+	}
+	cs, ok := control.(*ldap.ControlString)
+	if !ok {
+		return nil, errors.New("unexpected assertion control encoding")
+	}
+	packet := ber.DecodePacket([]byte(cs.ControlValue))
+	if packet == nil {
+		return nil, errors.New("invalid assertion control value")
+	}
+	if _, err := ldap.DecompileFilter(packet); err != nil {
+		return nil, err
+	}
+	return packet, nil
+}
+
+// assertionHolds evaluates the assertion against the entry named dn among entries. Without
+// such an entry, there is nothing for the assertion to hold on, and it fails
+func assertionHolds(filter *ber.Packet, entries []*ldap.Entry, dn string) bool {
+	for _, entry := range entries {
+		if strings.EqualFold(entry.DN, dn) {
+			ok, _ := ldap.ServerApplyFilter(filter, filterView(entry))
+			return ok
+		}
+	}
+	return false
+}
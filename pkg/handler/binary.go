@@ -0,0 +1,38 @@
+package handler
+
+import "strings"
+
+// binaryAttributes are attributes whose values are octet strings rather than text, by lowercased name
+var binaryAttributes = map[string]bool{
+	"audio":                     true,
+	"authorityrevocationlist":   true,
+	"cacertificate":             true,
+	"certificaterevocationlist": true,
+	"crosscertificatepair":      true,
+	"deltarevocationlist":       true,
+	"jpegphoto":                 true,
+	"msds-generationid":         true,
+	"msexchmailboxguid":         true,
+	"objectguid":                true,
+	"objectsid":                 true,
+	"photo":                     true,
+	"supportedalgorithms":       true,
+	"thumbnailphoto":            true,
+	"usercertificate":           true,
+	"userpkcs12":                true,
+	"usersmimecertificate":      true,
+	"x500uniqueidentifier":      true,
+}
+
+// isBinaryAttribute tells whether the values of an attribute, given by its description, are
+// binary: those must be passed along byte for byte, never rewritten nor made up from a filter
+func isBinaryAttribute(name string) bool {
+	name = strings.ToLower(name)
+	parts := strings.Split(name, ";")
+	for _, option := range parts[1:] {
+		if option == "binary" {
+			return true
+		}
+	}
+	return binaryAttributes[parts[0]]
+}
@@ -0,0 +1,118 @@
+package handler
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/etecs-ru/glauth/v2/pkg/stats"
+	"github.com/nmcclain/ldap"
+)
+
+// maxBindCacheTTL bounds how long a bind verdict may be reused, in seconds
+const maxBindCacheTTL = 60
+
+// boundCredentials records the credentials a backend session last bound with successfully
+type boundCredentials struct {
+	conn    *ldap.Conn // the upstream connection bound, to ignore sessions dialed again since
+	key     []byte
+	expires time.Time
+	dn      string // bind DN and user name in lower case, to evict the verdict on demand
+	user    string
+}
+
+// bindCache lets a client rebinding with the credentials its session is already bound with
+// be answered without a round trip to the upstream server. Only successful binds are kept,
+// for a short while, under a keyed hash of the DN and password; the hash key is drawn at
+// random per handler, so nothing survives a restart or a new configuration.
+type bindCache struct {
+	sync.Mutex
+	secret []byte
+	bound  map[string]boundCredentials // by session id
+}
+
+func newBindCache() *bindCache {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		panic(err)
+	}
+	return &bindCache{secret: secret, bound: make(map[string]boundCredentials)}
+}
+
+func (c *bindCache) key(bindDN, password string) []byte {
+	mac := hmac.New(sha256.New, c.secret)
+	mac.Write([]byte(strings.ToLower(bindDN)))
+	mac.Write([]byte{0})
+	mac.Write([]byte(password))
+	return mac.Sum(nil)
+}
+
+// hit tells whether the session is still bound with these credentials, verified recently
+func (c *bindCache) hit(s ldapSession, bindDN, password string) bool {
+	key := c.key(bindDN, password)
+	c.Lock()
+	defer c.Unlock()
+	b, ok := c.bound[s.id]
+	return ok && b.conn == s.ldap && time.Now().Before(b.expires) && hmac.Equal(b.key, key)
+}
+
+// store records a successful upstream bind of the session
+func (c *bindCache) store(s ldapSession, bindDN, userName, password string, ttl time.Duration) {
+	key := c.key(bindDN, password)
+	now := time.Now()
+	c.Lock()
+	defer c.Unlock()
+	for id, b := range c.bound {
+		if now.After(b.expires) {
+			delete(c.bound, id)
+		}
+	}
+	c.bound[s.id] = boundCredentials{conn: s.ldap, key: key, expires: now.Add(ttl),
+		dn: strings.ToLower(bindDN), user: strings.ToLower(userName)}
+}
+
+// forget drops what is known of the session, before it binds again: a failed bind leaves
+// the upstream connection anonymous
+func (c *bindCache) forget(s ldapSession) {
+	c.Lock()
+	delete(c.bound, s.id)
+	c.Unlock()
+}
+
+// clear drops every verdict, e.g. once the servers changed
+func (c *bindCache) clear() {
+	c.Lock()
+	c.bound = make(map[string]boundCredentials)
+	c.Unlock()
+}
+
+// evict drops the verdicts of binds as user, or with a DN under dn, or every verdict when
+// both are empty, and returns how many were dropped
+func (c *bindCache) evict(user, dn string) int {
+	user, dn = strings.ToLower(user), strings.ToLower(dn)
+	c.Lock()
+	defer c.Unlock()
+	evicted := 0
+	for id, b := range c.bound {
+		if (user == "" && dn == "") || (user != "" && b.user == user) || (dn != "" && dnUnder(b.dn, dn)) {
+			delete(c.bound, id)
+			evicted++
+		}
+	}
+	return evicted
+}
+
+// dnUnder tells whether the lowercased dn is base or one of its subordinates
+func dnUnder(dn, base string) bool {
+	return dn == base || strings.HasSuffix(dn, ","+base)
+}
+
+// EvictCache drops the bind verdicts cached for user, or for DNs under dn
+func (h ldapHandler) EvictCache(user, dn string) int {
+	evicted := h.binds.evict(user, dn)
+	stats.Frontend.Add("bind_cache_evictions", int64(evicted))
+	return evicted
+}
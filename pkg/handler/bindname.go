@@ -0,0 +1,88 @@
+package handler
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/etecs-ru/glauth/v2/pkg/config"
+)
+
+// bindNameExtractors recognize bind names that are not DNs, by form, returning the user name they carry
+var bindNameExtractors = map[string]func(string) (string, bool){
+	// "jdoe"
+	"bare": func(name string) (string, bool) {
+		if name == "" || strings.ContainsAny(name, "=,\\@") {
+			return "", false
+		}
+		return name, true
+	},
+	// "CORP\jdoe", as Windows clients send it
+	"domain": func(name string) (string, bool) {
+		i := strings.LastIndex(name, "\\")
+		if i <= 0 || i == len(name)-1 || strings.ContainsAny(name, "=,") {
+			return "", false
+		}
+		return name[i+1:], true
+	},
+}
+
+// bindNameUser returns the user name of a bind name in one of the forms a backend accepts
+// besides DNs, trying them in the configured order
+func bindNameUser(forms []string, bindDN string) (string, bool) {
+	for _, form := range forms {
+		if extract, ok := bindNameExtractors[form]; ok {
+			if userName, ok := extract(bindDN); ok {
+				return userName, true
+			}
+		}
+	}
+	return "", false
+}
+
+// passthroughUserName guesses the user name of a bind name passed through as it is, so that
+// users known under that name still have to send their OTP: "CORP\jdoe", "jdoe@corp.com"
+// and "cn=jdoe,ou=other,dc=corp" all give "jdoe"
+func passthroughUserName(lowerBindDN string) string {
+	if userName, ok := bindNameExtractors["domain"](lowerBindDN); ok {
+		return userName
+	}
+	if i := strings.Index(lowerBindDN, "@"); i > 0 && !strings.ContainsAny(lowerBindDN, "=,") {
+		return lowerBindDN[:i]
+	}
+	rdn := strings.Split(lowerBindDN, ",")[0]
+	return rdn[strings.Index(rdn, "=")+1:]
+}
+
+func validateBindNameForms(forms []string) error {
+	for _, form := range forms {
+		if _, ok := bindNameExtractors[form]; !ok {
+			return fmt.Errorf("Unknown bind name form: %s - must be one of 'bare', 'domain'", form)
+		}
+	}
+	return nil
+}
+
+// conformingBindDN tells whether a lowercased bind DN names a user the way the backend
+// expects, by a NameFormat RDN under BaseDN, so that the user name can be read from it.
+// Without NameFormat, any RDN will do, and without BaseDN, any DN.
+func conformingBindDN(backend config.Backend, lowerBindDN string) bool {
+	baseDN := strings.ToLower("," + backend.BaseDN)
+	if backend.BaseDN != "" && !strings.HasSuffix(lowerBindDN, baseDN) {
+		return false
+	}
+	rdn := strings.Split(strings.TrimSuffix(lowerBindDN, baseDN), ",")[0]
+	if backend.NameFormat == "" {
+		i := strings.Index(rdn, "=")
+		return i > 0 && i < len(rdn)-1
+	}
+	prefix := strings.ToLower(backend.NameFormat) + "="
+	return strings.HasPrefix(rdn, prefix) && len(rdn) > len(prefix)
+}
+
+func validateNonConformingBindDN(policy string) error {
+	switch policy {
+	case "", "reject", "invaliddn", "passthrough":
+		return nil
+	}
+	return fmt.Errorf("Unknown non-conforming bind DN policy: %s - must be one of 'reject', 'invaliddn', 'passthrough'", policy)
+}
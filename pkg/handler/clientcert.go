@@ -0,0 +1,59 @@
+package handler
+
+import (
+	"crypto/tls"
+	"net"
+
+	"go.uber.org/zap"
+)
+
+// ClientCertificate identifies the verified certificate a client presented over mutual TLS
+type ClientCertificate struct {
+	Subject string   `json:"subject"`
+	Issuer  string   `json:"issuer"`
+	Serial  string   `json:"serial"`
+	SAN     []string `json:"san,omitempty"`
+}
+
+// clientCertificate returns the verified client certificate of a TLS connection, or nil
+// for plain connections and clients that did not present one
+func clientCertificate(conn net.Conn) *ClientCertificate {
+	// *tls.Conn, or a connection wrapping one
+	tlsConn, ok := conn.(interface{ ConnectionState() tls.ConnectionState })
+	if !ok {
+		return nil
+	}
+	state := tlsConn.ConnectionState()
+	if len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	cert := state.VerifiedChains[0][0]
+	cc := ClientCertificate{
+		Subject: cert.Subject.String(),
+		Issuer:  cert.Issuer.String(),
+		Serial:  cert.SerialNumber.String(),
+	}
+	cc.SAN = append(cc.SAN, cert.DNSNames...)
+	cc.SAN = append(cc.SAN, cert.EmailAddresses...)
+	for _, ip := range cert.IPAddresses {
+		cc.SAN = append(cc.SAN, ip.String())
+	}
+	for _, uri := range cert.URIs {
+		cc.SAN = append(cc.SAN, uri.String())
+	}
+	return &cc
+}
+
+// clientCertFields returns the log fields describing the connection's client certificate, if any
+func clientCertFields(conn net.Conn) []zap.Field {
+	cc := clientCertificate(conn)
+	if cc == nil {
+		return nil
+	}
+	return []zap.Field{
+		zap.String("certsubject", cc.Subject),
+		zap.String("certissuer", cc.Issuer),
+		zap.String("certserial", cc.Serial),
+		zap.Strings("certsan", cc.SAN),
+	}
+}
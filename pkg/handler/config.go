@@ -3,6 +3,7 @@ package handler
 import (
 	"fmt"
 	"net"
+	"os"
 	"regexp"
 	"sort"
 	"strings"
@@ -21,6 +22,7 @@ type configHandler struct {
 	yubikeyAuth *yubigo.YubiAuth
 	ldohelper   LDAPOpsHelper
 	attmatcher  *regexp.Regexp
+	gids        *gidCache // nil unless gidNumbers come from a GidResolver
 }
 
 // NewConfigHandler creates a new config backed handler
@@ -35,6 +37,26 @@ func NewConfigHandler(opts ...Option) Handler {
 		ldohelper:   options.LDAPHelper,
 		attmatcher:  configattributematcher,
 	}
+	// the RDN attributes of returned user and group entries, also expected in bind DNs
+	if handler.backend.NameFormat == "" {
+		handler.backend.NameFormat = "cn"
+	}
+	if handler.backend.GroupFormat == "" {
+		handler.backend.GroupFormat = "ou"
+	}
+	if err := validateBindNameForms(handler.backend.BindNameForms); err != nil {
+		handler.log.Error("invalid bind name forms", zap.Error(err))
+		os.Exit(1)
+	}
+	if err := validateDeduplication(handler.backend.DeduplicateEntries); err != nil {
+		handler.log.Error("invalid deduplication strategy", zap.Error(err))
+		os.Exit(1)
+	}
+	var err error
+	if handler.gids, err = newGidCache(handler.backend, handler.log); err != nil {
+		handler.log.Error("invalid gid resolver", zap.Error(err))
+		os.Exit(1)
+	}
 	return handler
 }
 
@@ -63,17 +85,17 @@ func (h configHandler) Search(bindDN string, searchReq ldap.SearchRequest, conn
 
 // Add is not supported for a static config file
 func (h configHandler) Add(boundDN string, req ldap.AddRequest, conn net.Conn) (result ldap.LDAPResultCode, err error) {
-	return ldap.LDAPResultInsufficientAccessRights, nil
+	return writeResult(h.backend, "add")
 }
 
 // Modify is not supported for a static config file
 func (h configHandler) Modify(boundDN string, req ldap.ModifyRequest, conn net.Conn) (result ldap.LDAPResultCode, err error) {
-	return ldap.LDAPResultInsufficientAccessRights, nil
+	return writeResult(h.backend, "modify")
 }
 
 // Delete is not supported for a static config file
 func (h configHandler) Delete(boundDN string, deleteDN string, conn net.Conn) (result ldap.LDAPResultCode, err error) {
-	return ldap.LDAPResultInsufficientAccessRights, nil
+	return writeResult(h.backend, "delete")
 }
 
 func (h configHandler) FindUser(userName string, searchByUPN bool) (f bool, u config.User, err error) {
@@ -145,19 +167,23 @@ func (h configHandler) FindPosixAccounts(hierarchy string) (entrylist []*ldap.En
 
 		if len(u.LoginShell) > 0 {
 			attrs = append(attrs, &ldap.EntryAttribute{Name: "loginShell", Values: []string{u.LoginShell}})
+		} else if len(h.backend.LoginShellTemplate) > 0 {
+			attrs = append(attrs, &ldap.EntryAttribute{Name: "loginShell", Values: []string{h.expandUserTemplate(h.backend.LoginShellTemplate, u)}})
 		} else {
 			attrs = append(attrs, &ldap.EntryAttribute{Name: "loginShell", Values: []string{"/bin/bash"}})
 		}
 
 		if len(u.Homedir) > 0 {
 			attrs = append(attrs, &ldap.EntryAttribute{Name: "homeDirectory", Values: []string{u.Homedir}})
+		} else if len(h.backend.HomedirTemplate) > 0 {
+			attrs = append(attrs, &ldap.EntryAttribute{Name: "homeDirectory", Values: []string{h.expandUserTemplate(h.backend.HomedirTemplate, u)}})
 		} else {
 			attrs = append(attrs, &ldap.EntryAttribute{Name: "homeDirectory", Values: []string{"/home/" + u.Name}})
 		}
 
 		attrs = append(attrs, &ldap.EntryAttribute{Name: "description", Values: []string{fmt.Sprintf("%s", u.Name)}})
-		attrs = append(attrs, &ldap.EntryAttribute{Name: "gecos", Values: []string{fmt.Sprintf("%s", u.Name)}})
-		attrs = append(attrs, &ldap.EntryAttribute{Name: "gidNumber", Values: []string{fmt.Sprintf("%d", u.PrimaryGroup)}})
+		attrs = append(attrs, &ldap.EntryAttribute{Name: "gecos", Values: []string{h.gecos(u)}})
+		attrs = append(attrs, &ldap.EntryAttribute{Name: "gidNumber", Values: []string{fmt.Sprintf("%d", h.presentedGID(u.PrimaryGroup))}})
 		attrs = append(attrs, &ldap.EntryAttribute{Name: "memberOf", Values: h.getGroupDNs(append(u.OtherGroups, u.PrimaryGroup))})
 
 		attrs = append(attrs, &ldap.EntryAttribute{Name: "shadowExpire", Values: []string{"-1"}})
@@ -173,7 +199,13 @@ func (h configHandler) FindPosixAccounts(hierarchy string) (entrylist []*ldap.En
 		}
 
 		if len(u.CustomAttrs) > 0 {
-			for key, attr := range u.CustomAttrs {
+			keys := make([]string, 0, len(u.CustomAttrs))
+			for key := range u.CustomAttrs {
+				keys = append(keys, key)
+			}
+			sort.Strings(keys) // map iteration order would make the attribute order change between searches
+			for _, key := range keys {
+				attr := u.CustomAttrs[key]
 				switch typedattr := attr.(type) {
 				case []interface{}:
 					var values []string
@@ -210,16 +242,21 @@ func (h configHandler) FindPosixGroups(hierarchy string) (entrylist []*ldap.Entr
 	entries := []*ldap.Entry{}
 
 	for _, g := range h.cfg.Groups {
+		// memberships are kept by configured gidNumber, whatever number the group is presented with
+		gid, memberIDs := h.gids.resolve(g)
+		if memberIDs == nil {
+			memberIDs = h.getGroupMemberIDs(g.GIDNumber)
+		}
 		attrs := []*ldap.EntryAttribute{}
 		attrs = append(attrs, &ldap.EntryAttribute{Name: "cn", Values: []string{g.Name}})
 		attrs = append(attrs, &ldap.EntryAttribute{Name: "uid", Values: []string{g.Name}})
 		attrs = append(attrs, &ldap.EntryAttribute{Name: "description", Values: []string{fmt.Sprintf("%s", g.Name)}})
-		attrs = append(attrs, &ldap.EntryAttribute{Name: "gidNumber", Values: []string{fmt.Sprintf("%d", g.GIDNumber)}})
+		attrs = append(attrs, &ldap.EntryAttribute{Name: "gidNumber", Values: []string{fmt.Sprintf("%d", gid)}})
 		attrs = append(attrs, &ldap.EntryAttribute{Name: "uniqueMember", Values: h.getGroupMemberDNs(g.GIDNumber)})
 		if asGroupOfUniqueNames {
 			attrs = append(attrs, &ldap.EntryAttribute{Name: "objectClass", Values: []string{"groupOfUniqueNames", "top"}})
 		} else {
-			attrs = append(attrs, &ldap.EntryAttribute{Name: "memberUid", Values: h.getGroupMemberIDs(g.GIDNumber)})
+			attrs = append(attrs, &ldap.EntryAttribute{Name: "memberUid", Values: memberIDs})
 			attrs = append(attrs, &ldap.EntryAttribute{Name: "objectClass", Values: []string{"posixGroup", "top"}})
 		}
 		dn := fmt.Sprintf("%s=%s,%s,%s", h.backend.GroupFormat, g.Name, hierarchy, h.backend.BaseDN)
@@ -347,6 +384,55 @@ func (h configHandler) getGroupDNs(gids []int) []string {
 	return g
 }
 
+// expandUserTemplate replaces {username}, {uidnumber}, {gidnumber}, {group}, {givenname}, {sn}
+// and {mail} with the user's values, and {attribute} with the user's custom attribute, if a string
+func (h configHandler) expandUserTemplate(template string, u config.User) string {
+	pairs := []string{
+		"{username}", u.Name,
+		"{uidnumber}", fmt.Sprintf("%d", u.UIDNumber),
+		"{gidnumber}", fmt.Sprintf("%d", u.PrimaryGroup),
+		"{group}", h.getGroupName(u.PrimaryGroup),
+		"{givenname}", u.GivenName,
+		"{sn}", u.SN,
+		"{mail}", u.Mail,
+	}
+	for key, attr := range u.CustomAttrs {
+		if value, ok := attr.(string); ok {
+			pairs = append(pairs, "{"+key+"}", value)
+		}
+	}
+	expanded := strings.NewReplacer(pairs...).Replace(template)
+	// drop references to custom attributes the user does not have
+	return unsetTemplateReference.ReplaceAllString(expanded, "")
+}
+
+// unsetTemplateReference matches the {placeholders} left after expanding a user template
+var unsetTemplateReference = regexp.MustCompile(`\{[A-Za-z0-9_-]+\}`)
+
+// gecos composes the user's gecos from GecosTemplate, e.g. "{givenname} {sn},{office},{phone}",
+// omitting trailing empty components
+func (h configHandler) gecos(u config.User) string {
+	if h.backend.GecosTemplate == "" {
+		return u.Name
+	}
+	gecos := strings.TrimRight(h.expandUserTemplate(h.backend.GecosTemplate, u), ", ")
+	if gecos == "" {
+		return u.Name
+	}
+	return gecos
+}
+
+// presentedGID returns the gidNumber the group of configured gidNumber gid is presented with
+func (h configHandler) presentedGID(gid int) int {
+	for _, g := range h.cfg.Groups {
+		if g.GIDNumber == gid {
+			resolved, _ := h.gids.resolve(g)
+			return resolved
+		}
+	}
+	return gid
+}
+
 func (h configHandler) getGroupName(gid int) string {
 	for _, g := range h.cfg.Groups {
 		if g.GIDNumber == gid {
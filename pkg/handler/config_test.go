@@ -0,0 +1,262 @@
+package handler
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/etecs-ru/glauth/v2/pkg/config"
+	"github.com/nmcclain/ldap"
+	"github.com/pquerna/otp/totp"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+// newTestConfigHandler returns a config backend serving users, all members of a single group
+func newTestConfigHandler(backend config.Backend, users ...string) Handler {
+	cfg := &config.Config{
+		Behaviors: config.Behaviors{IgnoreCapabilities: true},
+		Groups:    []config.Group{{Name: "staff", GIDNumber: 5000}},
+	}
+	for i, name := range users {
+		cfg.Users = append(cfg.Users, config.User{Name: name, UIDNumber: 5001 + i, PrimaryGroup: 5000})
+	}
+	backend.Datastore = "config"
+	backend.BaseDN = "dc=example,dc=com"
+	return NewConfigHandler(
+		Backend(backend),
+		Logger(zap.NewNop()),
+		Config(cfg),
+		LDAPHelper(NewLDAPOpsHelper()),
+	)
+}
+
+func searchUsers(t *testing.T, h Handler) []string {
+	t.Helper()
+	conn, peer := net.Pipe()
+	defer conn.Close()
+	defer peer.Close()
+	result, err := h.Search("cn=alice,dc=example,dc=com", ldap.SearchRequest{
+		BaseDN: "ou=users,dc=example,dc=com",
+		Scope:  ldap.ScopeWholeSubtree,
+		Filter: "(objectClass=posixAccount)",
+	}, conn)
+	if err != nil || result.ResultCode != ldap.LDAPResultSuccess {
+		t.Fatalf("search failed: %d %v", result.ResultCode, err)
+	}
+	// the filter is left to the LDAP library, the ou entries above the users come along
+	var dns []string
+	for _, entry := range result.Entries {
+		if strings.HasPrefix(entry.DN, "cn=") {
+			dns = append(dns, entry.DN)
+		}
+	}
+	return dns
+}
+
+func TestSortEntries(t *testing.T) {
+	h := newTestConfigHandler(config.Backend{SortEntries: true}, "zoe", "alice", "Mallory", "bob")
+	dns := searchUsers(t, h)
+	if len(dns) != 4 {
+		t.Fatalf("expected 4 entries, got %v", dns)
+	}
+	for i := 1; i < len(dns); i++ {
+		if strings.ToLower(dns[i-1]) > strings.ToLower(dns[i]) {
+			t.Fatalf("entries not ordered by DN: %v", dns)
+		}
+	}
+	// the order is the same from one search to the next, and whatever the order of the config
+	again := searchUsers(t, newTestConfigHandler(config.Backend{SortEntries: true}, "bob", "Mallory", "zoe", "alice"))
+	if strings.Join(again, ";") != strings.Join(dns, ";") {
+		t.Fatalf("order changed with the config: %v then %v", dns, again)
+	}
+}
+
+func TestConfigOrderWithoutSortEntries(t *testing.T) {
+	dns := searchUsers(t, newTestConfigHandler(config.Backend{}, "zoe", "alice"))
+	if len(dns) != 2 || !strings.HasPrefix(dns[0], "cn=zoe,") || !strings.HasPrefix(dns[1], "cn=alice,") {
+		t.Fatalf("expected the order of the config, got %v", dns)
+	}
+}
+
+// searchEntryUUIDs returns the entryUUID of the users found, as sent by the frontend
+func searchEntryUUIDs(t *testing.T, filter string, attributes []string, users ...string) map[string]string {
+	t.Helper()
+	h := WithSearchChecks(newTestConfigHandler(config.Backend{EntryUUID: true}, users...), nil)
+	conn, peer := net.Pipe()
+	defer conn.Close()
+	defer peer.Close()
+	result, err := h.Search("cn=alice,dc=example,dc=com", ldap.SearchRequest{
+		BaseDN:     "ou=users,dc=example,dc=com",
+		Scope:      ldap.ScopeWholeSubtree,
+		Filter:     filter,
+		Attributes: attributes,
+	}, conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := map[string]string{}
+	for _, entry := range result.Entries {
+		found[strings.ToLower(entry.DN)] = entry.GetAttributeValue("entryUUID")
+	}
+	return found
+}
+
+func TestEntryUUIDStable(t *testing.T) {
+	first := searchEntryUUIDs(t, "(objectClass=posixAccount)", []string{"cn", "entryUUID"}, "alice", "bob")
+	// another handler, as after a restart, with the users listed the other way round
+	second := searchEntryUUIDs(t, "(objectClass=posixAccount)", []string{"cn", "entryUUID"}, "bob", "alice")
+	// operational attributes also come with "+"
+	operational := searchEntryUUIDs(t, "(objectClass=posixAccount)", []string{"+"}, "alice", "bob")
+	if len(first) == 0 || len(first) != len(second) || len(first) != len(operational) {
+		t.Fatalf("expected the same entries, got %v, %v and %v", first, second, operational)
+	}
+	seen := map[string]bool{}
+	for dn, uuid := range first {
+		if len(uuid) != 36 || uuid[14] != '5' {
+			t.Errorf("%s: not a version 5 UUID: %q", dn, uuid)
+		}
+		if second[dn] != uuid {
+			t.Errorf("%s: entryUUID changed from %s to %s", dn, uuid, second[dn])
+		}
+		if operational[dn] != uuid {
+			t.Errorf("%s: entryUUID %s requested with +, got %q", dn, uuid, operational[dn])
+		}
+		if seen[uuid] {
+			t.Errorf("%s: entryUUID %s shared with another entry", dn, uuid)
+		}
+		seen[uuid] = true
+	}
+}
+
+func TestEntryUUIDFilterOnly(t *testing.T) {
+	uuids := searchEntryUUIDs(t, "(objectClass=posixAccount)", []string{"entryUUID"}, "alice", "bob")
+	uuid := uuids["cn=bob,ou=staff,ou=users,dc=example,dc=com"]
+	if uuid == "" {
+		t.Fatalf("no entryUUID for bob in %v", uuids)
+	}
+	// the filter matches on entryUUID, which is not returned unless requested
+	found := searchEntryUUIDs(t, "(entryUUID="+uuid+")", nil, "alice", "bob")
+	if len(found) != 1 {
+		t.Fatalf("expected bob alone, got %v", found)
+	}
+	for dn, value := range found {
+		if value != "" {
+			t.Errorf("%s: entryUUID returned without being requested", dn)
+		}
+	}
+}
+
+func TestEntryQuotaChargesFilteredEntries(t *testing.T) {
+	users := []string{"alice", "bob", "carol", "dave", "erin"}
+	backend := newTestConfigHandler(config.Backend{}, append(users, "frank")...)
+	count := 0
+	cfg := &config.Config{Behaviors: config.Behaviors{EntryQuota: 3}}
+	h := WithEntryQuota(WithSearchChecks(backend, nil), HandlerWrapper{Handlers: []Handler{backend}, Count: &count}, cfg, zap.NewNop())
+	conn, peer := net.Pipe()
+	defer conn.Close()
+	defer peer.Close()
+	search := func(filter string) (ldap.ServerSearchResult, error) {
+		return h.Search("cn=frank,dc=example,dc=com", ldap.SearchRequest{
+			BaseDN: "ou=users,dc=example,dc=com",
+			Scope:  ldap.ScopeWholeSubtree,
+			Filter: filter,
+		}, conn)
+	}
+	// six users are in scope, but only the one matching the filter is sent, and charged
+	for i := 0; i < 3; i++ {
+		result, err := search("(uid=bob)")
+		if err != nil || result.ResultCode != ldap.LDAPResultSuccess || len(result.Entries) != 1 {
+			t.Fatalf("search %d: expected bob alone, got %d %v %d entries", i, result.ResultCode, err, len(result.Entries))
+		}
+	}
+	if result, _ := search("(uid=alice)"); result.ResultCode != ldap.LDAPResultAdminLimitExceeded {
+		t.Fatalf("expected the fourth entry to exceed the quota, got %d", result.ResultCode)
+	}
+}
+
+func TestAssertionOnBaseEntry(t *testing.T) {
+	h := newTestConfigHandler(config.Backend{}, "alice", "bob")
+	assertion := func(filter string) ldap.Control {
+		packet, err := ldap.CompileFilter(filter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ldap.NewControlString(ControlTypeAssertion, true, string(packet.Bytes()))
+	}
+	conn, peer := net.Pipe()
+	defer conn.Close()
+	defer peer.Close()
+	for _, tc := range []struct {
+		baseDN    string
+		scope     int
+		assertion string
+		expected  ldap.LDAPResultCode
+	}{
+		{"dc=example,dc=com", ldap.ScopeSingleLevel, "(objectClass=*)", ldap.LDAPResultSuccess},
+		{"ou=users,dc=example,dc=com", ldap.ScopeSingleLevel, "(objectClass=*)", ldap.LDAPResultSuccess},
+		{"ou=groups,dc=example,dc=com", ldap.ScopeSingleLevel, "(objectClass=*)", ldap.LDAPResultSuccess},
+		{"dc=example,dc=com", ldap.ScopeWholeSubtree, "(objectClass=*)", ldap.LDAPResultSuccess},
+		{"ou=users,dc=example,dc=com", ldap.ScopeWholeSubtree, "(ou=users)", ldap.LDAPResultSuccess},
+		{"ou=users,dc=example,dc=com", ldap.ScopeSingleLevel, "(ou=groups)", LDAPResultAssertionFailed},
+		{"ou=users,dc=example,dc=com", ldap.ScopeWholeSubtree, "(uid=alice)", LDAPResultAssertionFailed},
+	} {
+		// the scope or the filter leave the base entry out of the results, the assertion still applies to it
+		result, _ := h.Search("cn=alice,dc=example,dc=com", ldap.SearchRequest{
+			BaseDN:   tc.baseDN,
+			Scope:    tc.scope,
+			Filter:   "(objectClass=posixAccount)",
+			Controls: []ldap.Control{assertion(tc.assertion)},
+		}, conn)
+		if result.ResultCode != tc.expected {
+			t.Errorf("%s, scope %d, assertion %s: expected %d, got %d", tc.baseDN, tc.scope, tc.assertion, tc.expected, result.ResultCode)
+		}
+	}
+}
+
+func TestOTPGraceLogsMissingOrInvalid(t *testing.T) {
+	const secret = "JBSWY3DPEHPK3PXP"
+	core, logs := observer.New(zap.WarnLevel)
+	cfg := &config.Config{
+		Behaviors: config.Behaviors{IgnoreCapabilities: true, OTPGracePeriod: 1, OTPWindowsBefore: -1, OTPWindowsAfter: -1},
+		Groups:    []config.Group{{Name: "staff", GIDNumber: 5000}},
+		Users: []config.User{{
+			Name: "alice", UIDNumber: 5001, PrimaryGroup: 5000,
+			PassSHA256:  fmt.Sprintf("%x", sha256.Sum256([]byte("secretpw"))),
+			OTPSecret:   secret,
+			OTPEnrolled: time.Now(),
+		}},
+	}
+	h := NewConfigHandler(
+		Backend(config.Backend{Datastore: "config", BaseDN: "dc=example,dc=com"}),
+		Logger(zap.New(core)),
+		Config(cfg),
+		LDAPHelper(NewLDAPOpsHelper()),
+	)
+	code, err := totp.GenerateCode(secret, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, _ := strconv.Atoi(code)
+	wrong := fmt.Sprintf("%06d", (n+1)%1000000)
+	conn, peer := net.Pipe()
+	defer conn.Close()
+	defer peer.Close()
+	for _, tc := range []struct {
+		password string
+		expected string
+	}{
+		{"secretpw", "OTP missing, tolerated during the enrollment grace period"},
+		{"secretpw" + wrong, "OTP invalid, tolerated during the enrollment grace period"},
+	} {
+		logs.TakeAll()
+		h.Bind("cn=alice,ou=staff,dc=example,dc=com", tc.password, conn)
+		if found := logs.FilterMessage(tc.expected).Len(); found != 1 {
+			t.Errorf("bind with %q: expected %q logged once, got %v", tc.password, tc.expected, logs.All())
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package handler
+
+import (
+	"context"
+	"net"
+	"sync"
+
+	"github.com/nmcclain/ldap"
+)
+
+// ContextHandler is implemented by handlers able to honor cancellation, deadlines
+// and request-scoped values. Handlers that only implement Handler, such as existing
+// plugins, keep working: WithContext falls back to their plain methods.
+type ContextHandler interface {
+	BindContext(ctx context.Context, bindDN, bindSimplePw string, conn net.Conn) (ldap.LDAPResultCode, error)
+	SearchContext(ctx context.Context, boundDN string, searchReq ldap.SearchRequest, conn net.Conn) (ldap.ServerSearchResult, error)
+}
+
+// connContexts holds one context per client connection, cancelled when the connection closes
+var connContexts = struct {
+	sync.Mutex
+	ctxs map[net.Conn]connContext
+}{ctxs: make(map[net.Conn]connContext)}
+
+type connContext struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// ConnContext returns the context of a client connection. It is cancelled once
+// the connection is closed, aborting whatever backend work is still in flight.
+func ConnContext(conn net.Conn) context.Context {
+	connContexts.Lock()
+	defer connContexts.Unlock()
+	cc, ok := connContexts.ctxs[conn]
+	if !ok {
+		ctx, cancel := context.WithCancel(context.Background())
+		cc = connContext{ctx: ctx, cancel: cancel}
+		connContexts.ctxs[conn] = cc
+	}
+	return cc.ctx
+}
+
+// releaseConnContext cancels and forgets the context of a closed connection
+func releaseConnContext(conn net.Conn) {
+	connContexts.Lock()
+	cc, ok := connContexts.ctxs[conn]
+	delete(connContexts.ctxs, conn)
+	connContexts.Unlock()
+	if ok {
+		cc.cancel()
+	}
+}
+
+// contextHandler threads the connection context from the listener into a handler
+type contextHandler struct {
+	Handler
+}
+
+// WithContext wraps a handler so that the listener calls its context-aware methods, when
+// available, with the connection's context, and cancels that context when the connection closes
+func WithContext(h Handler) Handler {
+	return contextHandler{Handler: h}
+}
+
+func (c contextHandler) Bind(bindDN, bindSimplePw string, conn net.Conn) (ldap.LDAPResultCode, error) {
+	if ch, ok := c.Handler.(ContextHandler); ok {
+		return ch.BindContext(ConnContext(conn), bindDN, bindSimplePw, conn)
+	}
+	return c.Handler.Bind(bindDN, bindSimplePw, conn)
+}
+
+func (c contextHandler) Search(boundDN string, searchReq ldap.SearchRequest, conn net.Conn) (ldap.ServerSearchResult, error) {
+	if ch, ok := c.Handler.(ContextHandler); ok {
+		return ch.SearchContext(ConnContext(conn), boundDN, searchReq, conn)
+	}
+	return c.Handler.Search(boundDN, searchReq, conn)
+}
+
+func (c contextHandler) Close(boundDN string, conn net.Conn) error {
+	defer releaseConnContext(conn)
+	return c.Handler.Close(boundDN, conn)
+}
+
+// Stop forwards to the wrapped handler, if it has background tasks
+func (c contextHandler) Stop() {
+	if stopper, ok := c.Handler.(Stopper); ok {
+		stopper.Stop()
+	}
+}
@@ -0,0 +1,60 @@
+package handler
+
+import (
+	"net"
+	"strings"
+
+	"github.com/nmcclain/ldap"
+)
+
+// controlCritical tells whether a request control is marked critical. Only controls the
+// LDAP library does not decode itself keep their criticality, the others count as not critical
+func controlCritical(control ldap.Control) bool {
+	if cs, ok := control.(*ldap.ControlString); ok {
+		return cs.Criticality
+	}
+	return false
+}
+
+// allowedControls keeps the request controls whose OID is allowed to reach the upstream
+// server, all of them when no allowlist is configured. A critical control that is not
+// allowed cannot be honored, and fails the whole request as RFC 4511 requires.
+func allowedControls(allowed []string, controls []ldap.Control) ([]ldap.Control, ldap.LDAPResultCode, string) {
+	if len(allowed) == 0 {
+		return controls, ldap.LDAPResultSuccess, ""
+	}
+	kept := make([]ldap.Control, 0, len(controls))
+	for _, control := range controls {
+		oid := control.GetControlType()
+		ok := false
+		for _, a := range allowed {
+			if strings.TrimSpace(a) == oid {
+				ok = true
+				break
+			}
+		}
+		if ok {
+			kept = append(kept, control)
+		} else if controlCritical(control) {
+			return nil, ldap.LDAPResultUnavailableCriticalExtension, oid
+		}
+	}
+	return kept, ldap.LDAPResultSuccess, ""
+}
+
+// withClientAddress adds a control carrying the client's IP address under oid, for the
+// upstream server to audit. Any control of the same type sent by the client is dropped
+// first, so that the address cannot be forged.
+func withClientAddress(oid string, controls []ldap.Control, conn net.Conn) []ldap.Control {
+	address := conn.RemoteAddr().String()
+	if host, _, err := net.SplitHostPort(address); err == nil {
+		address = host
+	}
+	with := make([]ldap.Control, 0, len(controls)+1)
+	for _, control := range controls {
+		if control.GetControlType() != oid {
+			with = append(with, control)
+		}
+	}
+	return append(with, ldap.NewControlString(oid, false, address))
+}
@@ -0,0 +1,102 @@
+package handler
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/etecs-ru/glauth/v2/pkg/stats"
+	"github.com/nmcclain/ldap"
+)
+
+// deduplicateEntries drops entries whose DN was already returned. With the "first" strategy
+// the first occurrence is kept as is, with "merge" it also receives the attributes and values
+// of the later ones. An empty strategy leaves the entries alone.
+func deduplicateEntries(strategy string, entries []*ldap.Entry) []*ldap.Entry {
+	if strategy == "" || len(entries) < 2 {
+		return entries
+	}
+	seen := make(map[string]*ldap.Entry, len(entries))
+	kept := entries[:0]
+	for _, entry := range entries {
+		dn := strings.ToLower(entry.DN)
+		first, ok := seen[dn]
+		if !ok {
+			seen[dn] = entry
+			kept = append(kept, entry)
+			continue
+		}
+		if strategy == "merge" {
+			mergeEntry(first, entry)
+		}
+	}
+	return kept
+}
+
+// mergeEntry adds to entry the attributes and values of other it lacks
+func mergeEntry(entry, other *ldap.Entry) {
+	for _, attr := range other.Attributes {
+		existing := findAttribute(entry, attr.Name)
+		if existing == nil {
+			entry.Attributes = append(entry.Attributes, &ldap.EntryAttribute{Name: attr.Name, Values: append([]string(nil), attr.Values...)})
+			continue
+		}
+		for _, value := range attr.Values {
+			if !containsFold(existing.Values, value) {
+				existing.Values = append(existing.Values, value)
+			}
+		}
+	}
+}
+
+// deduplicateAttributes handles the attributes an entry carries more than once under the same
+// name, regardless of case. With the "first" strategy only the first occurrence is kept, with
+// "merge" it also receives the values of the later ones, in the order they came. An empty
+// strategy leaves the entries alone.
+func deduplicateAttributes(strategy string, entries []*ldap.Entry) {
+	if strategy == "" {
+		return
+	}
+	for _, entry := range entries {
+		if len(entry.Attributes) < 2 {
+			continue
+		}
+		seen := make(map[string]*ldap.EntryAttribute, len(entry.Attributes))
+		kept := make([]*ldap.EntryAttribute, 0, len(entry.Attributes))
+		for _, attr := range entry.Attributes {
+			name := strings.ToLower(attr.Name)
+			first, ok := seen[name]
+			if !ok {
+				seen[name] = attr
+				kept = append(kept, attr)
+				continue
+			}
+			stats.Frontend.Add("search_duplicate_attributes", 1)
+			if strategy == "merge" {
+				for _, value := range attr.Values {
+					if !contains(first.Values, value) {
+						first.Values = append(first.Values, value)
+					}
+				}
+			}
+		}
+		entry.Attributes = kept
+	}
+}
+
+// contains tells whether values holds value exactly, as values of an attribute may differ by case only
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func validateDeduplication(strategy string) error {
+	switch strategy {
+	case "", "first", "merge":
+		return nil
+	}
+	return fmt.Errorf("Unknown deduplication strategy: %s - must be one of 'first', 'merge'", strategy)
+}
@@ -0,0 +1,102 @@
+package handler
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/etecs-ru/glauth/v2/pkg/config"
+	"github.com/etecs-ru/glauth/v2/pkg/stats"
+	"github.com/nmcclain/ldap"
+)
+
+// failureDelays counts, per user and source address, the recent failed binds
+// that make the next failure answered more slowly
+type failureDelays struct {
+	sync.Mutex
+	failures map[string][]time.Time
+	stop     chan struct{} // closed on shutdown, ending pending delays
+	stopOnce sync.Once
+}
+
+// maxDelayedIdentities is the number of tracked user/address pairs above which stale ones are dropped
+const maxDelayedIdentities = 10000
+
+var delays = failureDelays{failures: make(map[string][]time.Time), stop: make(chan struct{})}
+
+// StopFailureDelays answers the failed binds still being delayed right away, on shutdown
+func StopFailureDelays() {
+	delays.stopOnce.Do(func() { close(delays.stop) })
+}
+
+// delayFailedBind holds back the answer to a failed bind, doubling the configured delay for
+// every recent failure of the same user from the same address, up to the configured maximum.
+// Successful binds are never delayed and forget past failures.
+func delayFailedBind(ctx context.Context, cfg *config.Config, bindDN string, conn net.Conn, resultCode ldap.LDAPResultCode) {
+	if cfg == nil || cfg.Behaviors.FailedBindDelay <= 0 {
+		return
+	}
+	src := conn.RemoteAddr().String()
+	if host, _, err := net.SplitHostPort(src); err == nil {
+		src = host
+	}
+	key := strings.ToLower(bindDN) + "|" + src
+	if resultCode == ldap.LDAPResultSuccess {
+		delays.Lock()
+		delete(delays.failures, key)
+		delays.Unlock()
+		return
+	}
+	if resultCode != ldap.LDAPResultInvalidCredentials {
+		return
+	}
+
+	window := cfg.Behaviors.PeriodOfFailedBinds * time.Second
+	if window <= 0 {
+		window = 60 * time.Second
+	}
+	max := time.Duration(cfg.Behaviors.FailedBindDelayMax) * time.Millisecond
+	if max <= 0 {
+		max = 5 * time.Second
+	}
+	now := time.Now()
+	delays.Lock()
+	recent := delays.failures[key][:0]
+	for _, ts := range delays.failures[key] {
+		if ts.Add(window).After(now) {
+			recent = append(recent, ts)
+		}
+	}
+	delays.failures[key] = append(recent, now)
+	if len(delays.failures) > maxDelayedIdentities {
+		delays.prune(now, window)
+	}
+	delays.Unlock()
+
+	delay := time.Duration(cfg.Behaviors.FailedBindDelay) * time.Millisecond
+	for i := 0; i < len(recent) && delay < max; i++ {
+		delay *= 2
+	}
+	if delay > max {
+		delay = max
+	}
+	stats.Frontend.Add("bind_failure_delays", 1)
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+	case <-delays.stop:
+	}
+}
+
+// prune forgets the pairs without failure in the current window, the lock must be held
+func (d *failureDelays) prune(now time.Time, window time.Duration) {
+	for key, failures := range d.failures {
+		if len(failures) == 0 || !failures[len(failures)-1].Add(window).After(now) {
+			delete(d.failures, key)
+		}
+	}
+}
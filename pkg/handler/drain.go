@@ -0,0 +1,63 @@
+package handler
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/etecs-ru/glauth/v2/pkg/stats"
+	"go.uber.org/zap"
+)
+
+// drainTimeout bounds the wait for the operations in flight on the sessions of a drained server
+const drainTimeout = time.Minute
+
+// releaseSession notes the end of an operation on a session obtained from getSession
+func (h ldapHandler) releaseSession(s ldapSession) {
+	atomic.AddInt32(s.inflight, -1)
+}
+
+// DrainServer takes the server at url out of the selection of new sessions, or puts it back
+// when draining is false. The sessions already open to it are closed once the operations in
+// flight on them complete, so that their clients move to the other servers.
+func (h ldapHandler) DrainServer(url string, draining bool) error {
+	h.lock.Lock()
+	k := h.serverIndex(url)
+	if k < 0 {
+		h.lock.Unlock()
+		return fmt.Errorf("no server %s", url)
+	}
+	(*h.servers)[k].Draining = draining
+	var drained []ldapSession
+	if draining {
+		for id, session := range h.sessions {
+			if session.server == url {
+				drained = append(drained, session)
+				delete(h.sessions, id)
+				stats.Backend.Add("sessions_live", -1)
+				stats.Backend.Add("sessions_drained", 1)
+			}
+		}
+	}
+	h.lock.Unlock()
+	if !draining {
+		h.log.Info("Server back in use", zap.String("url", url))
+		return nil
+	}
+	h.binds.clear()
+	h.log.Info("Draining server", zap.String("url", url), zap.Int("sessions", len(drained)))
+	go h.closeDrained(drained)
+	return nil
+}
+
+// closeDrained closes sessions taken out of use, each once no operation is using it anymore
+func (h ldapHandler) closeDrained(sessions []ldapSession) {
+	deadline := time.Now().Add(drainTimeout)
+	for _, s := range sessions {
+		for atomic.LoadInt32(s.inflight) > 0 && time.Now().Before(deadline) {
+			time.Sleep(100 * time.Millisecond)
+		}
+		s.ldap.Close()
+		stats.Backend.Add("sessions_closed", 1)
+	}
+}
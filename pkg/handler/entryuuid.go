@@ -0,0 +1,59 @@
+package handler
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"strings"
+
+	"github.com/etecs-ru/glauth/v2/pkg/config"
+	"github.com/nmcclain/ldap"
+)
+
+// entryUUIDNamespace is the UUID namespace of the entryUUID values derived from DNs; changing
+// it would change every entry's UUID
+var entryUUIDNamespace = [16]byte{
+	0x6f, 0x1c, 0x2b, 0x84, 0x5e, 0x0d, 0x4a, 0x39, 0x9b, 0x52, 0xc1, 0x7e, 0x03, 0xa8, 0xd4, 0x16,
+}
+
+// entryUUID returns the name-based (version 5) UUID of an entry, computed from its canonical DN
+// in lower case, so that it stays the same across restarts, reloads and reordered configurations
+func entryUUID(dn string) string {
+	name, err := config.CanonicalDN(dn)
+	if err != nil {
+		name = dn
+	}
+	hash := sha1.New()
+	hash.Write(entryUUIDNamespace[:])
+	hash.Write([]byte(strings.ToLower(name)))
+	u := hash.Sum(nil)[:16]
+	u[6] = u[6]&0x0f | 0x50
+	u[8] = u[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", u[0:4], u[4:6], u[6:8], u[8:10], u[10:16])
+}
+
+// wantsEntryUUID tells whether a search asks for entryUUID, by name or with "+", or filters on it
+func wantsEntryUUID(searchReq ldap.SearchRequest) bool {
+	for _, name := range searchReq.Attributes {
+		if name == "+" || strings.EqualFold(name, "entryUUID") {
+			return true
+		}
+	}
+	return strings.Contains(strings.ToLower(searchReq.Filter), "entryuuid")
+}
+
+// applyEntryUUIDs adds its entryUUID to every entry of the backend's tree, when the search
+// wants it. It is named "+entryUUID", as an operational attribute, for the frontend to only
+// return it when asked for, by name or with "+".
+func applyEntryUUIDs(backend config.Backend, searchReq ldap.SearchRequest, entries []*ldap.Entry) {
+	if !backend.EntryUUID || !wantsEntryUUID(searchReq) {
+		return
+	}
+	baseDN := strings.ToLower(backend.BaseDN)
+	for _, entry := range entries {
+		dn := strings.ToLower(entry.DN)
+		if (dn != baseDN && !strings.HasSuffix(dn, ","+baseDN)) || findAttribute(entry, "entryUUID") != nil || findAttribute(entry, "+entryUUID") != nil {
+			continue
+		}
+		entry.Attributes = append(entry.Attributes, &ldap.EntryAttribute{Name: "+entryUUID", Values: []string{entryUUID(entry.DN)}})
+	}
+}
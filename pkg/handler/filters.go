@@ -0,0 +1,70 @@
+package handler
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+
+	"github.com/etecs-ru/glauth/v2/pkg/stats"
+	ber "github.com/nmcclain/asn1-ber"
+	"github.com/nmcclain/ldap"
+)
+
+// filterTermBuckets are the upper bounds of the histogram of filter term counts
+var filterTermBuckets = []int{1, 2, 4, 8, 16, 32, 64, 128}
+
+// filterMetricsHandler measures the filter of every search, refusing those too complex
+type filterMetricsHandler struct {
+	Handler
+	maxDepth int
+	maxTerms int
+}
+
+// WithFilterMetrics wraps a handler so that the depth and number of terms of search filters
+// are recorded, as a histogram of term counts, and searches whose filter nests deeper than
+// maxDepth or holds more than maxTerms terms are refused; zero or less disables a limit
+func WithFilterMetrics(h Handler, maxDepth, maxTerms int) Handler {
+	return filterMetricsHandler{Handler: h, maxDepth: maxDepth, maxTerms: maxTerms}
+}
+
+func (f filterMetricsHandler) Search(boundDN string, searchReq ldap.SearchRequest, conn net.Conn) (ldap.ServerSearchResult, error) {
+	packet, err := ldap.CompileFilter(searchReq.Filter)
+	if err != nil {
+		stats.Frontend.Add("search_filters_rejected", 1)
+		stats.Frontend.Add("search_filters_unparsable", 1)
+		return ldap.ServerSearchResult{ResultCode: ldap.LDAPResultProtocolError}, fmt.Errorf("Search Error: invalid filter: %s", err)
+	}
+	depth, terms := filterComplexity(packet)
+	stats.Frontend.Add("search_filter_depth_sum", int64(depth))
+	stats.Frontend.Add("search_filter_terms_sum", int64(terms))
+	for _, bound := range filterTermBuckets {
+		if terms <= bound {
+			stats.Frontend.Add("search_filter_terms_le_"+strconv.Itoa(bound), 1)
+		}
+	}
+	stats.Frontend.Add("search_filter_terms_le_inf", 1)
+	if (f.maxDepth > 0 && depth > f.maxDepth) || (f.maxTerms > 0 && terms > f.maxTerms) {
+		stats.Frontend.Add("search_filters_rejected", 1)
+		stats.Frontend.Add("search_filters_too_complex", 1)
+		return ldap.ServerSearchResult{ResultCode: ldap.LDAPResultUnwillingToPerform},
+			fmt.Errorf("Search Error: filter too complex, %d levels and %d terms", depth, terms)
+	}
+	return f.Handler.Search(boundDN, searchReq, conn)
+}
+
+// filterComplexity returns how deep and/or/not operators nest in a filter, and how many
+// assertions it holds
+func filterComplexity(packet *ber.Packet) (depth, terms int) {
+	switch packet.Tag {
+	case ldap.FilterAnd, ldap.FilterOr, ldap.FilterNot:
+		for _, child := range packet.Children {
+			d, t := filterComplexity(child)
+			if d > depth {
+				depth = d
+			}
+			terms += t
+		}
+		return depth + 1, terms
+	}
+	return 1, 1
+}
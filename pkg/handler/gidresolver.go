@@ -0,0 +1,150 @@
+package handler
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/etecs-ru/glauth/v2/pkg/config"
+	"github.com/etecs-ru/glauth/v2/pkg/stats"
+	"go.uber.org/zap"
+)
+
+// defaultGidResolverTTL is how long resolved groups are cached when no TTL is configured
+const defaultGidResolverTTL = 5 * time.Minute
+
+// GidResolver looks groups up in a system of record other than the configuration
+type GidResolver interface {
+	// ResolveGroup returns the gidNumber of the group called name and the names of its
+	// members, nil to keep those of the configuration; found is false for unknown groups
+	ResolveGroup(name string) (gid int, members []string, found bool, err error)
+}
+
+var (
+	gidResolversLock sync.RWMutex
+	gidResolvers     = make(map[string]GidResolver)
+)
+
+// RegisterGidResolver makes resolver available under name, for config backends naming it in
+// gidresolver. It is meant to be called from an init function, and panics when name is taken
+// or resolver is nil.
+func RegisterGidResolver(name string, resolver GidResolver) {
+	gidResolversLock.Lock()
+	defer gidResolversLock.Unlock()
+	if resolver == nil {
+		panic("handler: RegisterGidResolver resolver is nil")
+	}
+	if _, dup := gidResolvers[name]; dup {
+		panic(fmt.Sprintf("handler: RegisterGidResolver called twice for %s", name))
+	}
+	gidResolvers[name] = resolver
+}
+
+// resolvedGroup is a cached answer of a GidResolver
+type resolvedGroup struct {
+	gid     int
+	members []string
+	found   bool
+	expires time.Time
+}
+
+// gidCache remembers the answers of a GidResolver for a while
+type gidCache struct {
+	sync.Mutex
+	resolver GidResolver
+	ttl      time.Duration
+	groups   map[string]resolvedGroup
+	log      *zap.Logger
+}
+
+// newGidCache returns the cache of the resolver named in the backend's settings, nil when
+// none is configured
+func newGidCache(backend config.Backend, log *zap.Logger) (*gidCache, error) {
+	if backend.GidResolver == "" {
+		return nil, nil
+	}
+	gidResolversLock.RLock()
+	resolver, ok := gidResolvers[backend.GidResolver]
+	gidResolversLock.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("no gid resolver registered as %s", backend.GidResolver)
+	}
+	ttl := time.Duration(backend.GidResolverTTL) * time.Second
+	if ttl <= 0 {
+		ttl = defaultGidResolverTTL
+	}
+	return &gidCache{resolver: resolver, ttl: ttl, groups: make(map[string]resolvedGroup), log: log}, nil
+}
+
+// resolve returns the gidNumber and members to present for a configured group: those of the
+// resolver when it knows the group, else the configured gidNumber and nil members. Failed
+// lookups are not cached, and fall back to the configuration too.
+func (c *gidCache) resolve(g config.Group) (int, []string) {
+	if c == nil {
+		return g.GIDNumber, nil
+	}
+	c.Lock()
+	cached, ok := c.groups[g.Name]
+	c.Unlock()
+	if !ok || time.Now().After(cached.expires) {
+		stats.Frontend.Add("gid_resolver_lookups", 1)
+		gid, members, found, err := c.resolver.ResolveGroup(g.Name)
+		if err != nil {
+			stats.Frontend.Add("gid_resolver_errors", 1)
+			c.log.Warn("Unable to resolve group, using the configured gidNumber", zap.String("group", g.Name), zap.Error(err))
+			return g.GIDNumber, nil
+		}
+		cached = resolvedGroup{gid: gid, members: members, found: found, expires: time.Now().Add(c.ttl)}
+		c.Lock()
+		c.groups[g.Name] = cached
+		c.Unlock()
+	}
+	if !cached.found {
+		return g.GIDNumber, nil
+	}
+	if cached.members == nil {
+		return cached.gid, nil
+	}
+	// entries are rewritten in place later on, the cached members must not be shared
+	return cached.gid, append([]string{}, cached.members...)
+}
+
+// evict drops the resolved groups for which match holds, and returns how many were dropped
+func (c *gidCache) evict(match func(name string, members []string) bool) int {
+	if c == nil {
+		return 0
+	}
+	c.Lock()
+	defer c.Unlock()
+	evicted := 0
+	for name, cached := range c.groups {
+		if match(name, cached.members) {
+			delete(c.groups, name)
+			evicted++
+		}
+	}
+	return evicted
+}
+
+// EvictCache drops the resolved groups user is a member of, or those dn names: a group, a
+// member, or the base DN or above for all of them
+func (h configHandler) EvictCache(user, dn string) int {
+	match := func(_ string, members []string) bool { return user == "" || containsFold(members, user) }
+	if dn = strings.ToLower(dn); dn != "" && !dnUnder(strings.ToLower(h.backend.BaseDN), dn) {
+		rdn := strings.SplitN(strings.SplitN(dn, ",", 2)[0], "=", 2)
+		switch {
+		case len(rdn) < 2:
+			return 0
+		case rdn[0] == strings.ToLower(h.backend.NameFormat):
+			match = func(_ string, members []string) bool { return containsFold(members, rdn[1]) }
+		case rdn[0] == strings.ToLower(h.backend.GroupFormat):
+			match = func(name string, _ []string) bool { return strings.EqualFold(name, rdn[1]) }
+		default:
+			return 0
+		}
+	}
+	evicted := h.gids.evict(match)
+	stats.Frontend.Add("gid_resolver_evictions", int64(evicted))
+	return evicted
+}
@@ -1,6 +1,8 @@
 package handler
 
 import (
+	"time"
+
 	"github.com/etecs-ru/glauth/v2/pkg/config"
 	"github.com/nmcclain/ldap"
 )
@@ -26,6 +28,48 @@ type Handler interface {
 	HelperMaker
 }
 
+// Stopper is implemented by handlers running background tasks that must be
+// terminated when the server shuts down
+type Stopper interface {
+	Stop()
+}
+
+// HealthChecker is implemented by handlers monitoring upstream servers
+type HealthChecker interface {
+	// CheckHealth triggers an immediate health check and returns its outcome
+	CheckHealth() ([]ServerStatus, error)
+	// ServerStatus returns the outcome of the latest health check
+	ServerStatus() []ServerStatus
+}
+
+// ServerUpdater is implemented by handlers whose upstream servers can change at runtime
+type ServerUpdater interface {
+	SetServers(servers []string) error
+}
+
+// ServerDrainer is implemented by handlers whose upstream servers can be taken out of use for maintenance
+type ServerDrainer interface {
+	DrainServer(url string, draining bool) error
+}
+
+// CacheEvicter is implemented by handlers caching what they learn from elsewhere
+type CacheEvicter interface {
+	// EvictCache drops what is cached about user, or about the entries under dn, or everything
+	// when both are empty, and returns how many cache entries were dropped
+	EvictCache(user, dn string) int
+}
+
+// ServerStatus is the health of one upstream server
+type ServerStatus struct {
+	URL      string
+	Up       bool
+	Ping     time.Duration
+	Priority int
+	Weight   int
+	Health   float64
+	Draining bool
+}
+
 // TODO When I grow up, I want to handle pointers same as I would in C
 // and not need a counter because I would not allocate statically
 // but use idiomatic slicing instead
@@ -2,7 +2,16 @@ package handler
 
 import (
 	"encoding/base64"
+	"fmt"
 	"strings"
+	"time"
+
+	"github.com/etecs-ru/glauth/v2/pkg/config"
+	"github.com/etecs-ru/glauth/v2/pkg/stats"
+	"github.com/nmcclain/ldap"
+	"github.com/pquerna/otp"
+	"github.com/pquerna/otp/totp"
+	"go.uber.org/zap"
 )
 
 func MaybeDecode(value string) string {
@@ -16,3 +25,138 @@ func MaybeDecode(value string) string {
 	}
 	return value
 }
+
+// writeResult answers a write operation the backend does not perform: denied by default,
+// or with a referral when WriteReferral is configured. The LDAP library sends write results
+// without referral URLs, nor diagnostic messages, so clients only learn that the operation
+// is to be made elsewhere: the URL is theirs to know. A non-nil error would turn the result
+// into operationsError.
+func writeResult(backend config.Backend, operation string) (ldap.LDAPResultCode, error) {
+	if backend.WriteReferral == "" {
+		return ldap.LDAPResultInsufficientAccessRights, nil
+	}
+	stats.Frontend.Add(operation+"_referrals", 1)
+	return ldap.LDAPResultReferral, nil
+}
+
+// applyEmptyBaseDNPolicy handles searches with an empty base DN other than root DSE queries:
+// "default" searches the backend's BaseDN instead, "reject" refuses them, anything else
+// leaves them alone
+func applyEmptyBaseDNPolicy(backend config.Backend, searchReq *ldap.SearchRequest) (ldap.LDAPResultCode, error) {
+	if searchReq.BaseDN != "" || searchReq.Scope == ldap.ScopeBaseObject {
+		return ldap.LDAPResultSuccess, nil
+	}
+	switch backend.EmptyBaseDN {
+	case "default":
+		searchReq.BaseDN = backend.BaseDN
+	case "reject":
+		stats.Frontend.Add("search_empty_base_rejected", 1)
+		return ldap.LDAPResultUnwillingToPerform, fmt.Errorf("Search Error: a base DN is required")
+	}
+	return ldap.LDAPResultSuccess, nil
+}
+
+// otpSecrets returns every TOTP secret enrolled by a user
+func otpSecrets(user config.User) []string {
+	if user.OTPSecret == "" {
+		return user.OTPSecrets
+	}
+	return append([]string{user.OTPSecret}, user.OTPSecrets...)
+}
+
+// otpPolicy returns the OTP policy enforced on a user: the configured one, else required of
+// users enrolled with a token the backend checks, and disabled for the others
+func otpPolicy(user config.User, enrolled bool) string {
+	switch {
+	case user.OTPPolicy != "":
+		return user.OTPPolicy
+	case enrolled:
+		return config.OTPRequired
+	}
+	return config.OTPDisabled
+}
+
+// otpGrace tells whether a user enrolled OTP recently enough for binds lacking the token to
+// be tolerated still
+func otpGrace(user config.User, behaviors config.Behaviors) bool {
+	if behaviors.OTPGracePeriod <= 0 || user.OTPEnrolled.IsZero() {
+		return false
+	}
+	return time.Since(user.OTPEnrolled) < behaviors.OTPGracePeriod*time.Hour
+}
+
+// otpPeriod is the lifetime, in seconds, of the TOTP codes GLAuth accepts
+const otpPeriod = 30
+
+// otpWindows returns how many code windows before and after the current one are accepted;
+// one each way unless the behaviors say otherwise, a negative count meaning none
+func otpWindows(behaviors config.Behaviors) (before, after int) {
+	if behaviors.OTPWindowsBefore == 0 && behaviors.OTPWindowsAfter == 0 {
+		return 1, 1
+	}
+	before, after = behaviors.OTPWindowsBefore, behaviors.OTPWindowsAfter
+	if before < 0 {
+		before = 0
+	}
+	if after < 0 {
+		after = 0
+	}
+	return before, after
+}
+
+// CurrentOTP returns the TOTP code a secret yields right now, as GLAuth validates it, and how
+// long until it rotates, e.g. for enrollment tools showing the code expected from a new device
+func CurrentOTP(secret string) (code string, remaining time.Duration, err error) {
+	now := time.Now().UTC()
+	code, err = totp.GenerateCodeCustom(secret, now, totp.ValidateOpts{
+		Period:    otpPeriod,
+		Digits:    otp.DigitsSix,
+		Algorithm: otp.AlgorithmSHA1,
+	})
+	if err != nil {
+		return "", 0, err
+	}
+	period := time.Duration(otpPeriod) * time.Second
+	return code, period - time.Duration(now.UnixNano())%period, nil
+}
+
+// validateOTP tells whether code is valid for any of the user's authenticators. Secrets that
+// cannot be decoded are logged as configuration errors, not taken for mismatches; when none of
+// the user's secrets can be, the code is refused, unless the behaviors say to let it through.
+func validateOTP(code string, user config.User, behaviors config.Behaviors, log *zap.Logger) bool {
+	before, after := otpWindows(behaviors)
+	opts := totp.ValidateOpts{
+		Period:    otpPeriod,
+		Skew:      0,
+		Digits:    otp.DigitsSix,
+		Algorithm: otp.AlgorithmSHA1,
+	}
+	now := time.Now().UTC()
+	secrets := otpSecrets(user)
+	broken := 0
+	for i, secret := range secrets {
+		// a secret that yields no code is misconfigured, whatever the user typed
+		if _, err := totp.GenerateCodeCustom(secret, now, opts); err != nil {
+			broken++
+			stats.Frontend.Add("bind_otp_secret_errors", 1)
+			log.Error("Invalid OTP secret", zap.String("user", user.Name), zap.Int("secret", i), zap.Error(err))
+			continue
+		}
+		// the current window first, then the past ones, which lagging clocks make the likeliest
+		for window := 0; window <= before+after; window++ {
+			offset := -window
+			if window > before {
+				offset = window - before
+			}
+			valid, err := totp.ValidateCustom(code, secret, now.Add(time.Duration(offset*otpPeriod)*time.Second), opts)
+			if err == nil && valid {
+				return true
+			}
+		}
+	}
+	if broken > 0 && broken == len(secrets) && behaviors.OTPErrorsFailOpen {
+		log.Warn("OTP not checked: no valid secret, letting the bind through", zap.String("user", user.Name))
+		return true
+	}
+	return false
+}
@@ -0,0 +1,207 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/etecs-ru/glauth/v2/pkg/config"
+	"github.com/etecs-ru/glauth/v2/pkg/stats"
+	"github.com/nmcclain/ldap"
+	"go.uber.org/zap"
+)
+
+// PreBindRequest is posted, as JSON, to the pre-bind webhook
+type PreBindRequest struct {
+	BindDN   string `json:"binddn"`
+	UserName string `json:"username"`
+	Src      string `json:"src"`
+	Backend  string `json:"backend"`
+
+	ClientCert *ClientCertificate `json:"clientcert,omitempty"`
+}
+
+// PreBindResponse is the verdict expected back from the pre-bind webhook
+type PreBindResponse struct {
+	Allow  bool   `json:"allow"`
+	Reason string `json:"reason"`
+}
+
+// preBindAllowed asks the configured webhook whether a bind may proceed.
+// Without a webhook, every bind is allowed.
+func preBindAllowed(ctx context.Context, cfg *config.Config, log *zap.Logger, backend config.Backend, bindDN, userName string, conn net.Conn) bool {
+	if cfg == nil || cfg.Hooks.PreBindURL == "" {
+		return true
+	}
+	src := conn.RemoteAddr().String()
+	if host, _, err := net.SplitHostPort(src); err == nil {
+		src = host
+	}
+	verdict, err := callPreBindHook(ctx, cfg.Hooks, PreBindRequest{BindDN: bindDN, UserName: userName, Src: src, Backend: backend.Datastore, ClientCert: clientCertificate(conn)})
+	if err != nil {
+		stats.Frontend.Add("prebind_hook_errors", 1)
+		log.Info("Pre-bind hook failed", zap.String("binddn", bindDN), zap.Bool("failopen", cfg.Hooks.PreBindFailOpen), zap.Error(err))
+		return cfg.Hooks.PreBindFailOpen
+	}
+	if !verdict.Allow {
+		stats.Frontend.Add("prebind_hook_denials", 1)
+		log.Info("Pre-bind hook denied bind", zap.String("binddn", bindDN), zap.String("src", src), zap.String("reason", verdict.Reason))
+	}
+	return verdict.Allow
+}
+
+func callPreBindHook(ctx context.Context, hooks config.Hooks, req PreBindRequest) (PreBindResponse, error) {
+	timeout := hooks.PreBindTimeout * time.Second
+	if timeout <= 0 {
+		timeout = 5 * time.Second
+	}
+	body, err := json.Marshal(req)
+	if err != nil {
+		return PreBindResponse{}, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, hooks.PreBindURL, bytes.NewReader(body))
+	if err != nil {
+		return PreBindResponse{}, err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(httpReq)
+	if err != nil {
+		return PreBindResponse{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return PreBindResponse{}, fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	var verdict PreBindResponse
+	if err := json.NewDecoder(resp.Body).Decode(&verdict); err != nil {
+		return PreBindResponse{}, err
+	}
+	return verdict, nil
+}
+
+// BindEvent describes the outcome of a bind, as delivered to post-bind sinks
+type BindEvent struct {
+	Time       time.Time `json:"time"`
+	BindDN     string    `json:"binddn"`
+	Src        string    `json:"src"`
+	Backend    string    `json:"backend"`
+	Success    bool      `json:"success"`
+	ResultCode int       `json:"resultcode"`
+
+	ClientCert *ClientCertificate `json:"clientcert,omitempty"`
+}
+
+type bindEventDispatcher struct {
+	once        sync.Once
+	lock        sync.Mutex // for subscribers
+	queue       chan BindEvent
+	subscribers []chan BindEvent
+	hooks       config.Hooks
+	log         *zap.Logger
+}
+
+var bindEvents bindEventDispatcher
+
+// SubscribeBindEvents returns a channel receiving every bind outcome.
+// Events are dropped, not queued, when the subscriber does not keep up.
+func SubscribeBindEvents(buffer int) <-chan BindEvent {
+	c := make(chan BindEvent, buffer)
+	bindEvents.lock.Lock()
+	bindEvents.subscribers = append(bindEvents.subscribers, c)
+	bindEvents.lock.Unlock()
+	return c
+}
+
+// emitBindEvent queues a bind outcome for the post-bind sinks without ever blocking the bind path
+func emitBindEvent(cfg *config.Config, log *zap.Logger, backend config.Backend, bindDN string, conn net.Conn, resultCode ldap.LDAPResultCode) {
+	if cfg == nil {
+		return
+	}
+	bindEvents.lock.Lock()
+	subscribed := len(bindEvents.subscribers) > 0
+	bindEvents.lock.Unlock()
+	if cfg.Hooks.PostBindURL == "" && cfg.Hooks.PostBindFile == "" && !subscribed {
+		return
+	}
+	bindEvents.once.Do(func() {
+		buffer := cfg.Hooks.PostBindBuffer
+		if buffer <= 0 {
+			buffer = 1000
+		}
+		bindEvents.hooks = cfg.Hooks
+		bindEvents.log = log
+		bindEvents.queue = make(chan BindEvent, buffer)
+		go bindEvents.deliver()
+	})
+	src := conn.RemoteAddr().String()
+	if host, _, err := net.SplitHostPort(src); err == nil {
+		src = host
+	}
+	ev := BindEvent{
+		Time:       time.Now(),
+		BindDN:     bindDN,
+		Src:        src,
+		Backend:    backend.Datastore,
+		Success:    resultCode == ldap.LDAPResultSuccess,
+		ResultCode: int(resultCode),
+		ClientCert: clientCertificate(conn),
+	}
+	select {
+	case bindEvents.queue <- ev:
+	default:
+		stats.Frontend.Add("postbind_events_dropped", 1)
+	}
+}
+
+func (d *bindEventDispatcher) deliver() {
+	client := http.Client{Timeout: 5 * time.Second}
+	for ev := range d.queue {
+		d.lock.Lock()
+		for _, c := range d.subscribers {
+			select {
+			case c <- ev:
+			default:
+				stats.Frontend.Add("postbind_events_dropped", 1)
+			}
+		}
+		d.lock.Unlock()
+
+		line, err := json.Marshal(ev)
+		if err != nil {
+			continue
+		}
+		if d.hooks.PostBindFile != "" {
+			if err := appendLine(d.hooks.PostBindFile, line); err != nil {
+				stats.Frontend.Add("postbind_hook_errors", 1)
+				d.log.Info("Post-bind event could not be written", zap.String("file", d.hooks.PostBindFile), zap.Error(err))
+			}
+		}
+		if d.hooks.PostBindURL != "" {
+			resp, err := client.Post(d.hooks.PostBindURL, "application/json", bytes.NewReader(line))
+			if err != nil {
+				stats.Frontend.Add("postbind_hook_errors", 1)
+				d.log.Info("Post-bind hook failed", zap.String("url", d.hooks.PostBindURL), zap.Error(err))
+				continue
+			}
+			resp.Body.Close()
+		}
+	}
+}
+
+func appendLine(filename string, line []byte) error {
+	f, err := os.OpenFile(filename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.Write(append(line, '\n'))
+	return err
+}
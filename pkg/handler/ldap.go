@@ -1,9 +1,14 @@
 package handler
 
 import (
+	"context"
+	"crypto/rand"
 	"crypto/sha256"
 	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net"
 	"net/url"
@@ -12,12 +17,13 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+	"unicode/utf8"
 
 	"github.com/etecs-ru/glauth/v2/pkg/config"
 	"github.com/etecs-ru/glauth/v2/pkg/stats"
 	"github.com/nmcclain/ldap"
-	"github.com/pquerna/otp/totp"
 	"go.uber.org/zap"
 )
 
@@ -26,23 +32,54 @@ var ldapattributematcher = regexp.MustCompile(`(?i)(?P<attribute>[a-zA-Z0-9]+)\s
 
 type ldapHandler struct {
 	backend  config.Backend
+	cfg      *config.Config
 	handlers HandlerWrapper
 	doPing   chan bool
+	recheck  chan chan error // operator-requested pings, answered once done
+	done     chan struct{}   // closed to stop the monitor goroutine
+	stopOnce *sync.Once
 	log      *zap.Logger
 	lock     *sync.Mutex // for sessions and servers
 	sessions map[string]ldapSession
-	servers  []ldapBackend
+	servers  *[]ldapBackend // replaced as a whole by SetServers
 	helper   Handler
 	attm     *regexp.Regexp
+	favorite *selectedServer // last server returned by getBestServer
+	health   *healthLog
+	binds    *bindCache
+	ldapsTLS *tls.Config // for ldaps servers
+	startTLS *tls.Config // for ldap servers, nil to stay in clear text
+	dialer   *net.Dialer // for ldaps servers, carries the configured source address
+	codes    resultCodeMap
+	standby  *standbyPool
+	sticky   *stickyServers
+}
+
+// healthHeartbeat is how often the servers' health is logged while it does not change
+const healthHeartbeat = 15 * time.Minute
+
+// healthLog keeps ping() from logging the same health over and over
+type healthLog struct {
+	sync.Mutex
+	checked bool      // whether the servers were pinged before
+	logged  time.Time // when the servers' health was last logged
+}
+
+// selectedServer remembers the preferred server, to notice when the selection changes
+type selectedServer struct {
+	sync.Mutex
+	address string
 }
 
 // global lock for ldapHandler sessions & servers manipulation
 var ldaplock sync.Mutex
 
 type ldapSession struct {
-	id   string
-	c    net.Conn
-	ldap *ldap.Conn
+	id       string
+	c        net.Conn
+	ldap     *ldap.Conn
+	server   string // url of the server the session is opened to
+	inflight *int32 // operations using the session, which draining its server waits for
 }
 type ldapBackendStatus int
 
@@ -57,6 +94,12 @@ type ldapBackend struct {
 	Port     int
 	Status   ldapBackendStatus
 	Ping     time.Duration
+	Priority int // lower values are preferred, like SRV priority
+	Weight   int // higher values are preferred among servers of equal priority, like SRV weight
+	// smoothed rate of successful pings, from 0 to 1
+	Health float64
+	// excluded from new sessions until further notice, see DrainServer
+	Draining bool
 }
 
 func NewLdapHandler(opts ...Option) Handler {
@@ -64,91 +107,280 @@ func NewLdapHandler(opts ...Option) Handler {
 
 	handler := ldapHandler{ // set non-zero-value defaults here
 		backend:  options.Backend,
+		cfg:      options.Config,
 		handlers: options.Handlers,
 		sessions: make(map[string]ldapSession),
 		doPing:   make(chan bool),
+		recheck:  make(chan chan error),
+		done:     make(chan struct{}),
+		stopOnce: &sync.Once{},
 		log:      options.Logger,
 		helper:   options.Helper,
 		lock:     &ldaplock,
 		attm:     ldapattributematcher,
+		favorite: &selectedServer{},
+		health:   &healthLog{},
+		binds:    newBindCache(),
+		sticky:   newStickyServers(),
+		standby:  &standbyPool{},
 	}
-	// parse LDAP URLs
-	for _, ldapurl := range handler.backend.Servers {
-		l, err := parseURL(ldapurl)
-		if err != nil {
-			handler.log.Error("could not parse url", zap.Error(err))
+	if err := validateSessionIdentity(handler.backend.SessionIdentity); err != nil {
+		handler.log.Error("invalid session identity", zap.Error(err))
+		os.Exit(1)
+	}
+	if err := validateDegradedSearch(handler.backend.DegradedSearch); err != nil {
+		handler.log.Error("invalid degraded search policy", zap.Error(err))
+		os.Exit(1)
+	}
+	if err := validateDeduplication(handler.backend.DeduplicateEntries); err != nil {
+		handler.log.Error("invalid deduplication strategy", zap.Error(err))
+		os.Exit(1)
+	}
+	if err := validateDeduplication(handler.backend.DuplicateAttributes); err != nil {
+		handler.log.Error("invalid duplicate attribute strategy", zap.Error(err))
+		os.Exit(1)
+	}
+	if err := validateMissingBaseDN(handler.backend.MissingBaseDN); err != nil {
+		handler.log.Error("invalid missing base DN policy", zap.Error(err))
+		os.Exit(1)
+	}
+	if err := validateStickyUsers(handler.backend.StickyUsers); err != nil {
+		handler.log.Error("invalid sticky users strategy", zap.Error(err))
+		os.Exit(1)
+	}
+	if err := validateNonConformingBindDN(handler.backend.NonConformingBindDN); err != nil {
+		handler.log.Error("invalid non-conforming bind DN policy", zap.Error(err))
+		os.Exit(1)
+	}
+	if handler.backend.BindCacheTTL < 0 || handler.backend.BindCacheTTL > maxBindCacheTTL {
+		handler.log.Error("invalid bind cache TTL, must be between 0 and 60 seconds", zap.Int("bindcachettl", handler.backend.BindCacheTTL))
+		os.Exit(1)
+	}
+	if err := validateBindNameForms(handler.backend.BindNameForms); err != nil {
+		handler.log.Error("invalid bind name forms", zap.Error(err))
+		os.Exit(1)
+	}
+	if handler.backend.HealthThreshold < 0 || handler.backend.HealthThreshold > 1 || handler.backend.HealthSmoothing < 0 || handler.backend.HealthSmoothing > 1 {
+		handler.log.Error("invalid server health settings, must be between 0 and 1",
+			zap.Float64("healththreshold", handler.backend.HealthThreshold), zap.Float64("healthsmoothing", handler.backend.HealthSmoothing))
+		os.Exit(1)
+	}
+	if handler.backend.WeightBlend < 0 || handler.backend.WeightBlend > 100 {
+		handler.log.Error("invalid weight blend, must be between 0 and 100", zap.Int("weightblend", handler.backend.WeightBlend))
+		os.Exit(1)
+	}
+	var err error
+	if handler.dialer, err = localDialer(handler.backend.LocalAddr); err != nil {
+		handler.log.Error("invalid local address", zap.String("localaddr", handler.backend.LocalAddr), zap.Error(err))
+		os.Exit(1)
+	}
+	if handler.codes, err = newResultCodeMap(handler.backend.ResultCodeMappings); err != nil {
+		handler.log.Error("invalid result code mappings", zap.Error(err))
+		os.Exit(1)
+	}
+	if handler.ldapsTLS, err = handler.tlsConfig(handler.backend.LDAPSTLS); err != nil {
+		handler.log.Error("invalid LDAPS settings", zap.Error(err))
+		os.Exit(1)
+	}
+	if handler.backend.StartTLS != nil {
+		if handler.startTLS, err = handler.tlsConfig(handler.backend.StartTLS); err != nil {
+			handler.log.Error("invalid StartTLS settings", zap.Error(err))
+			os.Exit(1)
+		}
+	}
+	if handler.backend.ServersSRV != "" {
+		if len(handler.backend.Servers) > 0 {
+			handler.log.Error("servers and serverssrv cannot both be set")
+			os.Exit(1)
+		}
+		if handler.backend.Servers, err = lookupSRV(handler.backend.ServersSRV); err != nil {
+			handler.log.Error("could not look up servers", zap.String("serverssrv", handler.backend.ServersSRV), zap.Error(err))
 			os.Exit(1)
 		}
-		handler.servers = append(handler.servers, l)
 	}
+	// parse LDAP URLs
+	servers, err := parseURLs(handler.backend.Servers)
+	if err != nil {
+		handler.log.Error("could not parse url", zap.Error(err))
+		os.Exit(1)
+	}
+	if err := handler.validateLocalAddr(servers); err != nil {
+		handler.log.Error("invalid local address", zap.String("localaddr", handler.backend.LocalAddr), zap.Error(err))
+		os.Exit(1)
+	}
+	handler.servers = &servers
 
 	// test server connectivity before listening, then keep it updated
 	handler.monitorServers()
+	if handler.backend.ServersSRV != "" {
+		go handler.watchSRV(handler.backend.Servers)
+	}
 
 	return handler
 }
 
 //
 func (h ldapHandler) Bind(bindDN, bindSimplePw string, conn net.Conn) (resultCode ldap.LDAPResultCode, err error) {
-	h.log.Info("Bind request", zap.String("binddn", bindDN), zap.String("src", conn.RemoteAddr().String()))
+	return h.BindContext(ConnContext(conn), bindDN, bindSimplePw, conn)
+}
 
-	//	if h.helper != nil {
-	if true {
+// BindContext forwards the bind to the best backend server, giving up when ctx is done
+func (h ldapHandler) BindContext(ctx context.Context, bindDN, bindSimplePw string, conn net.Conn) (resultCode ldap.LDAPResultCode, err error) {
+	h.log.Info("Bind request", append([]zap.Field{zap.String("binddn", bindDN), zap.String("src", conn.RemoteAddr().String())}, clientCertFields(conn)...)...)
+	defer func() { emitBindEvent(h.cfg, h.log, h.backend, bindDN, conn, resultCode) }()
+	defer func() { delayFailedBind(ctx, h.cfg, bindDN, conn, resultCode) }()
 
-		lowerBindDN := strings.ToLower(bindDN)
-		baseDN := strings.ToLower("," + h.backend.BaseDN)
-		parts := strings.Split(strings.TrimSuffix(lowerBindDN, baseDN), ",")
-		userName := strings.TrimPrefix(parts[0], h.backend.NameFormat+"=")
+	if InMaintenance() {
+		return maintenanceBindResult(h.cfg.Behaviors, h.log, bindDN, conn)
+	}
+
+	// RFC 4513 5.1.2: a name with an empty password is an unauthenticated bind,
+	// which the backend may happily accept, so refuse it unless told otherwise
+	if bindDN != "" && bindSimplePw == "" && !h.backend.AllowUnauthenticatedBind {
+		stats.Frontend.Add("bind_unauthenticated_rejections", 1)
+		h.log.Info("Unauthenticated bind rejected", zap.String("binddn", bindDN), zap.String("src", conn.RemoteAddr().String()))
+		return ldap.LDAPResultInvalidCredentials, nil
+	}
+
+	// the whole bind, user lookup and hooks included, is bounded by the configured timeout;
+	// ctx itself is left alone as the delay of failed binds must outlive it
+	opCtx := ctx
+	if timeout := time.Duration(h.backend.BindTimeout) * time.Second; timeout > 0 {
+		var cancel context.CancelFunc
+		opCtx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	lowerBindDN := strings.ToLower(bindDN)
+	baseDN := strings.ToLower("," + h.backend.BaseDN)
+	parts := strings.Split(strings.TrimSuffix(lowerBindDN, baseDN), ",")
+	userName := strings.TrimPrefix(parts[0], h.backend.NameFormat+"=")
+	if name, ok := bindNameUser(h.backend.BindNameForms, lowerBindDN); ok {
+		userName = name
+	} else if bindDN != "" && !conformingBindDN(h.backend, lowerBindDN) {
+		// the user name, hence the OTP check, would be guessed from a DN that does not carry it
+		stats.Frontend.Add("bind_nonconforming_dn", 1)
+		switch h.backend.NonConformingBindDN {
+		case "passthrough":
+			// the name may still designate a known user, whose OTP is then required as usual
+			userName = passthroughUserName(lowerBindDN)
+			h.log.Info("Bind DN not under the base, passed through", zap.String("binddn", bindDN), zap.String("username", userName), zap.String("src", conn.RemoteAddr().String()))
+		case "invaliddn":
+			h.log.Warn("Bind refused: DN not under the base", zap.String("binddn", bindDN), zap.String("src", conn.RemoteAddr().String()))
+			return ldap.LDAPResultInvalidDNSyntax, nil
+		default:
+			h.log.Warn("Bind refused: DN not under the base", zap.String("binddn", bindDN), zap.String("src", conn.RemoteAddr().String()))
+			return ldap.LDAPResultInvalidCredentials, nil
+		}
+	}
 
+	//	if h.helper != nil {
+	if true {
 		validotp := false
+		otpMissing := false
 
 		// Find the user
 		// We are going to go through all backends and ask
 		// until we find our user or die of boredom.
-		user := config.User{}
-		found := false
-		for i, handler := range h.handlers.Handlers {
-			found, user, _ = handler.FindUser(userName, false)
-			if found {
-				break
-			}
-			if i >= *h.handlers.Count {
-				break
-			}
+		found, user := h.findUserInHandlers(userName)
+		if opCtx.Err() != nil {
+			return h.bindTimedOut(bindDN, conn)
 		}
 
-		if !found {
+		policy := otpPolicy(user, len(otpSecrets(user)) > 0)
+		grace := policy == config.OTPRequired && otpGrace(user, h.cfg.Behaviors)
+		if !found || policy == config.OTPDisabled {
 			validotp = true
 		} else {
-			if len(user.OTPSecret) == 0 {
-				validotp = true
-			} else {
-				if len(bindSimplePw) > 6 {
-					otp := bindSimplePw[len(bindSimplePw)-6:]
-					bindSimplePw = bindSimplePw[:len(bindSimplePw)-6]
-					validotp = totp.Validate(otp, user.OTPSecret)
+			// users with an optional OTP may leave the token out, the password then goes upstream as sent
+			sentBindSimplePw := bindSimplePw
+			// a password made of the token alone would be empty once stripped,
+			// which the upstream server would take for an unauthenticated bind
+			if len(bindSimplePw) == 6 && policy == config.OTPRequired && !grace {
+				stats.Frontend.Add("bind_otp_empty_password", 1)
+				h.log.Warn("Bind refused: password empty once the OTP is stripped", zap.String("binddn", bindDN), zap.String("src", conn.RemoteAddr().String()))
+				return ldap.LDAPResultInvalidCredentials, nil
+			}
+			otpMissing = len(bindSimplePw) < 6
+			if len(bindSimplePw) > 6 && len(otpSecrets(user)) > 0 {
+				otp := bindSimplePw[len(bindSimplePw)-6:]
+				bindSimplePw = bindSimplePw[:len(bindSimplePw)-6]
+				validotp = validateOTP(otp, user, h.cfg.Behaviors, h.log)
+			}
+			if !validotp && grace {
+				stats.Frontend.Add("bind_otp_grace", 1)
+				message := "OTP invalid, tolerated during the enrollment grace period"
+				if otpMissing {
+					message = "OTP missing, tolerated during the enrollment grace period"
 				}
+				h.log.Warn(message,
+					zap.String("binddn", bindDN), zap.String("src", conn.RemoteAddr().String()), zap.Time("enrolled", user.OTPEnrolled))
+				validotp, bindSimplePw = true, sentBindSimplePw
+			}
+			if !validotp && policy == config.OTPOptional {
+				stats.Frontend.Add("bind_otp_optional_skipped", 1)
+				validotp, bindSimplePw = true, sentBindSimplePw
 			}
 		}
 
 		if !validotp {
 			h.log.Info(fmt.Sprintf("Bind Error: invalid OTP token as %s from %s", bindDN, conn.RemoteAddr().String()))
+			// the upstream server holds the password: only a password too short to carry a token is told apart
+			if h.cfg.Behaviors.ReportMissingOTP && otpMissing {
+				stats.Frontend.Add("bind_otp_missing", 1)
+				h.log.Info(fmt.Sprintf("Bind Error: OTP required as %s from %s", bindDN, conn.RemoteAddr().String()))
+			}
 			return ldap.LDAPResultInvalidCredentials, nil
 		}
 	}
 
+	// a truncated password is not worth a round trip, and an empty one would bind anonymously upstream
+	if utf8.RuneCountInString(bindSimplePw) < h.backend.MinPasswordLength {
+		stats.Frontend.Add("bind_short_password_rejections", 1)
+		h.log.Info("Bind refused: password too short", zap.String("binddn", bindDN), zap.String("src", conn.RemoteAddr().String()))
+		return ldap.LDAPResultInvalidCredentials, nil
+	}
+
 	stats.Frontend.Add("bind_reqs", 1)
-	s, err := h.getSession(conn)
+	if !preBindAllowed(opCtx, h.cfg, h.log, h.backend, bindDN, userName, conn) {
+		if opCtx.Err() != nil {
+			return h.bindTimedOut(bindDN, conn)
+		}
+		return ldap.LDAPResultInvalidCredentials, nil
+	}
+	s, err := h.getSession(conn, bindDN)
 	if err != nil {
 		stats.Frontend.Add("bind_ldapSession_errors", 1)
 		h.log.Info("could not get session",
 			zap.String("binddn", bindDN), zap.String("src", conn.RemoteAddr().String()), zap.Error(err))
 		return ldap.LDAPResultOperationsError, err
 	}
-	if err := s.ldap.Bind(bindDN, bindSimplePw); err != nil {
+	defer h.releaseSession(s)
+	if opCtx.Err() != nil {
+		return h.bindTimedOut(bindDN, conn)
+	}
+	ttl := time.Duration(h.backend.BindCacheTTL) * time.Second
+	if ttl > 0 {
+		if h.binds.hit(s, bindDN, bindSimplePw) {
+			stats.Frontend.Add("bind_cache_hits", 1)
+			stats.Frontend.Add("bind_successes", 1)
+			h.log.Info("bind success", zap.String("binddn", bindDN), zap.String("src", conn.RemoteAddr().String()), zap.Bool("cached", true))
+			return ldap.LDAPResultSuccess, nil
+		}
+		h.binds.forget(s)
+	}
+	err = h.retryBusy(opCtx, "bind", func() error { return h.bindWithDeadline(opCtx, s, bindDN, bindSimplePw) })
+	if err != nil {
+		if err == context.DeadlineExceeded {
+			return h.bindTimedOut(bindDN, conn)
+		}
 		stats.Frontend.Add("bind_errors", 1)
+		h.maybeDropSession(s, err)
 		h.log.Info("invalid creds", zap.String("binddn", bindDN), zap.String("src", conn.RemoteAddr().String()))
-		return ldap.LDAPResultInvalidCredentials, nil
+		return h.codes.translate(err, ldap.LDAPResultInvalidCredentials), nil
+	}
+	if ttl > 0 {
+		h.binds.store(s, bindDN, userName, bindSimplePw, ttl)
 	}
 	stats.Frontend.Add("bind_successes", 1)
 	h.log.Info("bind success", zap.String("binddn", bindDN), zap.String("src", conn.RemoteAddr().String()))
@@ -157,6 +389,11 @@ func (h ldapHandler) Bind(bindDN, bindSimplePw string, conn net.Conn) (resultCod
 
 //
 func (h ldapHandler) Search(boundDN string, searchReq ldap.SearchRequest, conn net.Conn) (result ldap.ServerSearchResult, err error) {
+	return h.SearchContext(ConnContext(conn), boundDN, searchReq, conn)
+}
+
+// SearchContext forwards the search to the best backend server, abandoning it when ctx is done
+func (h ldapHandler) SearchContext(ctx context.Context, boundDN string, searchReq ldap.SearchRequest, conn net.Conn) (result ldap.ServerSearchResult, err error) {
 	wantAttributes := true
 	wantTypesOnly := false
 
@@ -177,26 +414,70 @@ func (h ldapHandler) Search(boundDN string, searchReq ldap.SearchRequest, conn n
 	}
 
 	stats.Frontend.Add("search_reqs", 1)
-	s, err := h.getSession(conn)
+	if ldapcode, err := applyEmptyBaseDNPolicy(h.backend, &searchReq); ldapcode != ldap.LDAPResultSuccess {
+		return ldap.ServerSearchResult{ResultCode: ldapcode}, err
+	}
+	controls, ldapcode, oid := allowedControls(h.backend.ForwardedControls, searchReq.Controls)
+	if ldapcode != ldap.LDAPResultSuccess {
+		stats.Frontend.Add("search_unavailable_controls", 1)
+		h.log.Info("Search refused: critical control not forwarded", zap.String("control", oid), zap.String("filter", searchReq.Filter))
+		return ldap.ServerSearchResult{ResultCode: ldapcode}, fmt.Errorf("Search Error: critical control %s is not supported", oid)
+	}
+	if h.backend.ClientAddressControl != "" {
+		controls = withClientAddress(h.backend.ClientAddressControl, controls, conn)
+	}
+	s, err := h.getSession(conn, boundDN)
 	if err != nil {
 		stats.Frontend.Add("search_ldapSession_errors", 1)
-		return ldap.ServerSearchResult{ResultCode: ldap.LDAPResultOperationsError}, nil
+		return h.degradedSearchResult(searchReq, err)
+	}
+	defer h.releaseSession(s)
+	// have the upstream server stop one entry past our cap, so that going over it can be told apart
+	sizeLimit := searchReq.SizeLimit
+	if max := h.backend.MaxResponseEntries; max > 0 && (sizeLimit == 0 || sizeLimit > max) {
+		sizeLimit = max + 1
 	}
 	search := ldap.NewSearchRequest(
 		searchReq.BaseDN,
 		searchReq.Scope,
 		searchReq.DerefAliases,
-		searchReq.SizeLimit,
+		sizeLimit,
 		searchReq.TimeLimit,
 		searchReq.TypesOnly,
 		searchReq.Filter,
 		searchReq.Attributes,
-		searchReq.Controls,
+		controls,
 	)
 
 	h.log.Info("Search request to backend", zap.Any("request", search))
-	sr, err := s.ldap.Search(search)
+	var sr *ldap.SearchResult
+	err = h.retryBusy(ctx, "search", func() (err error) {
+		sr, err = h.searchWithDeadline(ctx, s, search)
+		return err
+	})
+	if err == context.Canceled {
+		stats.Frontend.Add("search_cancellations", 1)
+		h.log.Info("Search abandoned: cancelled", zap.String("filter", search.Filter))
+		return ldap.ServerSearchResult{ResultCode: ldap.LDAPResultOther}, err
+	}
+	if err == errSearchDeadline || err == context.DeadlineExceeded {
+		stats.Frontend.Add("search_timeouts", 1)
+		h.log.Info("Search abandoned: time limit exceeded", zap.String("filter", search.Filter))
+		// the LDAP library only sends the result code of searches failing with an error
+		return ldap.ServerSearchResult{ResultCode: ldap.LDAPResultTimeLimitExceeded}, errors.New("Search Error: time limit exceeded")
+	}
+	h.maybeDropSession(s, err)
+	sr, err = h.missingBaseResult(ctx, s, search.BaseDN, sr, err)
+	if sr != nil && !h.withinResponseLimits(sr) {
+		stats.Frontend.Add("search_response_too_large", 1)
+		h.log.Warn("Search abandoned: backend response too large", zap.String("filter", search.Filter), zap.Int("numentries", len(sr.Entries)))
+		h.abandonSession(s)
+		return ldap.ServerSearchResult{ResultCode: ldap.LDAPResultSizeLimitExceeded}, fmt.Errorf("Search Error: backend response exceeds the configured limits")
+	}
 	h.log.Info("Backend Search result", zap.Any("result", sr))
+	if sr == nil {
+		sr = &ldap.SearchResult{}
+	}
 
 	if !wantAttributes {
 		h.log.Info("AP: Search Info", zap.String("type", "No attributes"))
@@ -236,38 +517,27 @@ func (h ldapHandler) Search(boundDN string, searchReq ldap.SearchRequest, conn n
 		h.log.Info("AP: Search Info", zap.String("type", "Root search detected"))
 	}
 
-	filters := h.buildReqAttributesList(searchReq.Filter, []string{})
-
-	for _, filter := range filters {
-		attbits := h.attm.FindStringSubmatch(filter)
-		for _, entry := range sr.Entries {
-			foundattname := false
-			for _, attribute := range entry.Attributes {
-				if strings.ToLower(attribute.Name) == strings.ToLower(attbits[1]) {
-					foundattname = true
-					if len(attbits[2]) == 0 {
-						attribute.Values = []string{attbits[2]}
-					}
-					break
-				}
-			}
-			if !foundattname {
-				entry.Attributes = append(entry.Attributes, &ldap.EntryAttribute{Name: attbits[1], Values: []string{attbits[2]}})
-			}
-		}
-	}
+	deduplicateAttributes(h.backend.DuplicateAttributes, sr.Entries)
+	sr.Entries = deduplicateEntries(h.backend.DeduplicateEntries, sr.Entries)
+	h.reinsertFilterAttributes(h.filterAttributes(searchReq.Filter), requestedAttributes(searchReq.Attributes, wantAttributes), sr.Entries)
+	applyFixedAttributes(h.backend.FixedAttributes, h.backend.BaseDN, sr.Entries)
+	applyAttributeTransforms(h.backend.AttributeTransforms, sr.Entries)
 
 	ssr := ldap.ServerSearchResult{
 		Entries:   sr.Entries,
 		Referrals: sr.Referrals,
 		Controls:  sr.Controls,
 	}
+	// the upstream server matched the filter before trimming the values it was asked to
+	if ldap.FindControl(controls, ControlTypeMatchedValues) != nil {
+		ssr.Controls = markFilterMatched(ssr.Controls)
+	}
 	h.log.Info("Frontend Search result", zap.Any("result", ssr))
 	if err != nil {
 		e := err.(*ldap.Error)
 		h.log.Info("Search Err", zap.Error(err))
 		stats.Frontend.Add("search_errors", 1)
-		ssr.ResultCode = ldap.LDAPResultCode(e.ResultCode)
+		ssr.ResultCode = h.codes.translate(err, ldap.LDAPResultCode(e.ResultCode))
 		return ssr, err
 	}
 	stats.Frontend.Add("search_successes", 1)
@@ -275,6 +545,230 @@ func (h ldapHandler) Search(boundDN string, searchReq ldap.SearchRequest, conn n
 	return ssr, nil
 }
 
+// degradedSearchResult answers a search that could not reach any server, as configured.
+// GLAuth keeps no cache of past results, so there is nothing stale to serve instead.
+// The error is what makes the library send the result code: with a nil error it would
+// answer success.
+func (h ldapHandler) degradedSearchResult(searchReq ldap.SearchRequest, err error) (ldap.ServerSearchResult, error) {
+	switch h.backend.DegradedSearch {
+	case "unavailable":
+		stats.Frontend.Add("search_degraded_unavailable", 1)
+		h.log.Info("Search answered while degraded", zap.String("policy", "unavailable"), zap.String("filter", searchReq.Filter), zap.Error(err))
+		return ldap.ServerSearchResult{ResultCode: ldap.LDAPResultUnavailable}, err
+	case "empty":
+		stats.Frontend.Add("search_degraded_empty", 1)
+		h.log.Info("Search answered while degraded", zap.String("policy", "empty"), zap.String("filter", searchReq.Filter), zap.Error(err))
+		return ldap.ServerSearchResult{Entries: []*ldap.Entry{}, Referrals: []string{}, Controls: []ldap.Control{}, ResultCode: ldap.LDAPResultSuccess}, nil
+	}
+	stats.Frontend.Add("search_degraded_error", 1)
+	return ldap.ServerSearchResult{ResultCode: ldap.LDAPResultOperationsError}, fmt.Errorf("Search Error: %s", err)
+}
+
+// withinResponseLimits tells whether a backend response stays within the configured entry and
+// size caps. The LDAP client library only hands results over once complete, so the size cap
+// keeps oversized results from being passed on, not from being received.
+func (h ldapHandler) withinResponseLimits(sr *ldap.SearchResult) bool {
+	if max := h.backend.MaxResponseEntries; max > 0 && len(sr.Entries) > max {
+		return false
+	}
+	max := h.backend.MaxResponseBytes
+	if max <= 0 {
+		return true
+	}
+	size := 0
+	for _, entry := range sr.Entries {
+		size += len(entry.DN)
+		for _, attr := range entry.Attributes {
+			size += len(attr.Name)
+			for _, v := range attr.Values {
+				size += len(v)
+			}
+		}
+		if size > max {
+			return false
+		}
+	}
+	return true
+}
+
+// findUserInHandlers goes through all backends and asks
+// until we find our user or die of boredom.
+func (h ldapHandler) findUserInHandlers(userName string) (bool, config.User) {
+	for i, handler := range h.handlers.Handlers {
+		if found, user, _ := handler.FindUser(userName, false); found {
+			return true, user
+		}
+		if i >= *h.handlers.Count {
+			break
+		}
+	}
+	return false, config.User{}
+}
+
+var errSearchDeadline = errors.New("search time limit exceeded")
+
+// bindWithDeadline runs a backend bind until ctx is done, dropping the session, which
+// abandons the upstream operation, when it is done first
+func (h ldapHandler) bindWithDeadline(ctx context.Context, s ldapSession, bindDN, bindSimplePw string) error {
+	if ctx.Done() == nil {
+		return s.ldap.Bind(bindDN, bindSimplePw)
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- s.ldap.Bind(bindDN, bindSimplePw)
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		h.abandonSession(s)
+		return ctx.Err()
+	}
+}
+
+// bindTimedOut answers a bind that ran out of time; the LDAP library only sends the result
+// code of binds returning no error
+func (h ldapHandler) bindTimedOut(bindDN string, conn net.Conn) (ldap.LDAPResultCode, error) {
+	stats.Frontend.Add("bind_timeouts", 1)
+	h.log.Info("Bind abandoned: time limit exceeded", zap.String("binddn", bindDN), zap.String("src", conn.RemoteAddr().String()))
+	return ldap.LDAPResultTimeLimitExceeded, nil
+}
+
+// searchWithDeadline runs a backend search bounded by the effective time limit: the client's
+// own limit, capped by the configured MaxTimeLimit, and by ctx. When the deadline elapses or ctx
+// is done first, the session is dropped, which abandons the upstream operation.
+func (h ldapHandler) searchWithDeadline(ctx context.Context, s ldapSession, search *ldap.SearchRequest) (*ldap.SearchResult, error) {
+	limit := time.Duration(search.TimeLimit) * time.Second
+	if maxLimit := h.cfg.Behaviors.MaxTimeLimit * time.Second; maxLimit > 0 && (limit == 0 || limit > maxLimit) {
+		limit = maxLimit
+	}
+	if limit == 0 && ctx.Done() == nil {
+		return s.ldap.Search(search)
+	}
+
+	type searchResult struct {
+		sr  *ldap.SearchResult
+		err error
+	}
+	done := make(chan searchResult, 1)
+	go func() {
+		sr, err := s.ldap.Search(search)
+		done <- searchResult{sr, err}
+	}()
+	var expired <-chan time.Time
+	if limit > 0 {
+		timer := time.NewTimer(limit)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	select {
+	case r := <-done:
+		return r.sr, r.err
+	case <-expired:
+		h.abandonSession(s)
+		return nil, errSearchDeadline
+	case <-ctx.Done():
+		h.abandonSession(s)
+		return nil, ctx.Err()
+	}
+}
+
+// abandonSession closes a session whose operation is still running upstream
+func (h ldapHandler) abandonSession(s ldapSession) {
+	h.lock.Lock()
+	if _, ok := h.sessions[s.id]; ok {
+		delete(h.sessions, s.id)
+		stats.Backend.Add("sessions_live", -1)
+		stats.Backend.Add("sessions_closed_error", 1)
+	}
+	h.lock.Unlock()
+	s.ldap.Close()
+}
+
+// filterAttribute is an attribute assertion extracted from a search filter
+type filterAttribute struct {
+	name  string
+	lower string
+	value string
+}
+
+// filterAttributes extracts the attribute assertions of a filter once, lowercasing names up front
+func (h ldapHandler) filterAttributes(filter string) []filterAttribute {
+	filters := h.buildReqAttributesList(filter, []string{})
+	fas := make([]filterAttribute, 0, len(filters))
+	for _, filter := range filters {
+		filter = strings.TrimSpace(filter)
+		attbits := h.attm.FindStringSubmatch(filter)
+		if len(attbits) != 3 {
+			continue
+		}
+		// the match must cover the whole attribute description: "usercertificate;binary=..."
+		// would otherwise yield an attribute named "binary"
+		if !strings.HasPrefix(filter, attbits[1]) || isBinaryAttribute(attbits[1]) {
+			continue
+		}
+		fas = append(fas, filterAttribute{name: attbits[1], lower: strings.ToLower(attbits[1]), value: attbits[2]})
+	}
+	return fas
+}
+
+// requestedAttributes tells whether an attribute, given by its lowercased name,
+// was part of the attributes the backend was asked to return
+func requestedAttributes(requested []string, wantAttributes bool) func(string) bool {
+	if !wantAttributes {
+		return func(string) bool { return false }
+	}
+	names := make(map[string]bool, len(requested))
+	for _, name := range requested {
+		if name == "*" {
+			return func(string) bool { return true }
+		}
+		names[strings.ToLower(name)] = true
+	}
+	if len(names) == 0 {
+		return func(string) bool { return true }
+	}
+	return func(lower string) bool { return names[lower] }
+}
+
+// reinsertFilterAttributes makes sure every entry carries the attributes the filter asserts on,
+// so that the LDAP library does not weed the entry out. Only attributes the backend was not
+// asked for are added, as the library drops them again once it has applied the filter;
+// a requested attribute that is absent does not exist and is not made up.
+func (h ldapHandler) reinsertFilterAttributes(fas []filterAttribute, requested func(string) bool, entries []*ldap.Entry) {
+	if len(fas) == 0 {
+		return
+	}
+	// a single index, reset for every entry, maps lowercased names to the entry's attributes
+	index := make(map[string]*ldap.EntryAttribute)
+	for _, entry := range entries {
+		for name := range index {
+			delete(index, name)
+		}
+		for _, attribute := range entry.Attributes {
+			lower := strings.ToLower(attribute.Name)
+			if _, ok := index[lower]; !ok {
+				index[lower] = attribute
+			}
+		}
+		for _, fa := range fas {
+			if attribute, ok := index[fa.lower]; ok {
+				// only fill in values that were stripped, never replace real ones
+				if len(attribute.Values) == 0 {
+					attribute.Values = []string{fa.value}
+				}
+				continue
+			}
+			if requested(fa.lower) {
+				continue
+			}
+			attribute := &ldap.EntryAttribute{Name: fa.name, Values: []string{fa.value}}
+			entry.Attributes = append(entry.Attributes, attribute)
+			index[fa.lower] = attribute
+		}
+	}
+}
+
 func (h ldapHandler) buildReqAttributesList(filter string, filters []string) []string {
 	maxp := len(filter)
 	start := -1
@@ -300,17 +794,17 @@ func (h ldapHandler) buildReqAttributesList(filter string, filters []string) []s
 
 // Add is not yet supported for the ldap backend
 func (h ldapHandler) Add(boundDN string, req ldap.AddRequest, conn net.Conn) (result ldap.LDAPResultCode, err error) {
-	return ldap.LDAPResultInsufficientAccessRights, nil
+	return writeResult(h.backend, "add")
 }
 
 // Modify is not yet supported for the ldap backend
 func (h ldapHandler) Modify(boundDN string, req ldap.ModifyRequest, conn net.Conn) (result ldap.LDAPResultCode, err error) {
-	return ldap.LDAPResultInsufficientAccessRights, nil
+	return writeResult(h.backend, "modify")
 }
 
 // Delete is not yet supported for the ldap backend
 func (h ldapHandler) Delete(boundDN string, deleteDN string, conn net.Conn) (result ldap.LDAPResultCode, err error) {
-	return ldap.LDAPResultInsufficientAccessRights, nil
+	return writeResult(h.backend, "delete")
 }
 
 func (h ldapHandler) FindUser(userName string, searchByUPN bool) (found bool, user config.User, err error) {
@@ -325,77 +819,246 @@ func (h ldapHandler) Close(boundDn string, conn net.Conn) error {
 	conn.Close() // close connection to the server when then client is closed
 	h.lock.Lock()
 	defer h.lock.Unlock()
-	delete(h.sessions, connID(conn))
+	id := sessionID(h.backend.SessionIdentity, conn)
+	forgetSessionID(conn)
+	if s, ok := h.sessions[id]; ok {
+		s.ldap.Close()
+		delete(h.sessions, id)
+		stats.Backend.Add("sessions_live", -1)
+	}
+	stats.Backend.Add("sessions_closed", 1)
 	stats.Frontend.Add("closes", 1)
 	stats.Backend.Add("closes", 1)
 	return nil
 }
 
+// maybeDropSession discards a session whose backend connection failed at the network level,
+// so that the next operation on the same client connection opens a fresh one
+func (h ldapHandler) maybeDropSession(s ldapSession, err error) {
+	e, ok := err.(*ldap.Error)
+	if !ok || e.ResultCode != ldap.ErrorNetwork {
+		return
+	}
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if _, ok := h.sessions[s.id]; !ok {
+		return
+	}
+	s.ldap.Close()
+	delete(h.sessions, s.id)
+	stats.Backend.Add("sessions_live", -1)
+	stats.Backend.Add("sessions_closed_error", 1)
+}
+
+// startupPing pings the servers until one is healthy, up to the configured number of attempts
+func (h *ldapHandler) startupPing() error {
+	attempts := h.backend.StartupPingAttempts
+	if attempts < 1 {
+		attempts = 1
+	}
+	interval := time.Duration(h.backend.StartupPingInterval) * time.Second
+	var err error
+	for attempt := 1; attempt <= attempts; attempt++ {
+		if err = h.ping(); err == nil {
+			return nil
+		}
+		if attempt < attempts {
+			h.log.Info("servers unreachable at startup, retrying",
+				zap.Int("attempt", attempt), zap.Int("attempts", attempts), zap.Duration("interval", interval), zap.Error(err))
+			time.Sleep(interval)
+		}
+	}
+	return err
+}
+
 // monitorServers tests server connectivity before listening, then keeps it updated
+// pingWhileRunning checks the servers once started: no server answering is logged, while
+// binds fail and searches get the DegradedSearch answer, until one comes back
+func (h *ldapHandler) pingWhileRunning() {
+	if err := h.ping(); err != nil {
+		stats.Backend.Add("ping_all_down", 1)
+		h.log.Error("could not ping server", zap.Error(err))
+	}
+}
+
 func (h *ldapHandler) monitorServers() {
-	err := h.ping()
+	err := h.startupPing()
 	if err != nil {
 		h.log.Error("could not ping server", zap.Error(err))
 		os.Exit(1)
 		// TODO return error
 	}
 	go func() {
+		h.refreshStandby()
 		for {
 			select {
+			case <-h.done:
+				h.standby.closeAll()
+				h.log.Info("Server monitoring stopped")
+				return
+			case reply := <-h.recheck:
+				h.log.Info("doPing requested by operator")
+				// no healthy server is reported to the operator rather than fatal
+				reply <- h.ping()
 			case <-h.doPing:
 				h.log.Info("doPing requested due to server failure")
-				err = h.ping()
-				if err != nil {
-					h.log.Error("could not ping server", zap.Error(err))
-					os.Exit(1)
-					// TODO return error
-				}
+				h.pingWhileRunning()
 			case <-time.NewTimer(60 * time.Second).C:
 				h.log.Info("doPing after timeout")
-				err = h.ping()
-				if err != nil {
-					h.log.Error("could not ping server", zap.Error(err))
-					os.Exit(1)
-					// TODO return error
-				}
+				h.pingWhileRunning()
 			}
+			h.refreshStandby()
 		}
 	}()
 }
 
+// SetServers replaces the list of upstream servers at runtime. Servers already known keep
+// their health, new ones are pinged right away, and the sessions opened to removed ones
+// are closed so that their clients move to the remaining servers.
+func (h ldapHandler) SetServers(urls []string) error {
+	servers, err := parseURLs(urls)
+	if err != nil {
+		return err
+	}
+	if len(servers) == 0 {
+		return errors.New("at least one server is required")
+	}
+	if err := h.validateLocalAddr(servers); err != nil {
+		return err
+	}
+	kept := make(map[string]bool)
+	h.lock.Lock()
+	for i, s := range servers {
+		if k := h.serverIndex(s.url()); k >= 0 {
+			servers[i].Status = (*h.servers)[k].Status
+			servers[i].Ping = (*h.servers)[k].Ping
+			servers[i].Health = (*h.servers)[k].Health
+			servers[i].Draining = (*h.servers)[k].Draining
+		}
+		kept[s.url()] = true
+	}
+	for _, s := range *h.servers {
+		if !kept[s.url()] {
+			h.log.Info("Removing server", zap.String("url", s.url()))
+		}
+	}
+	*h.servers = servers
+	var drained []ldapSession
+	for id, session := range h.sessions {
+		if !kept[session.server] {
+			drained = append(drained, session)
+			delete(h.sessions, id)
+			stats.Backend.Add("sessions_live", -1)
+			stats.Backend.Add("sessions_closed", 1)
+		}
+	}
+	h.lock.Unlock()
+	h.binds.clear()
+	for _, session := range drained {
+		session.ldap.Close()
+	}
+	h.log.Info("Servers updated", zap.Strings("servers", urls), zap.Int("drainedsessions", len(drained)))
+	if err := h.ping(); err != nil {
+		return fmt.Errorf("servers updated, but: %s", err)
+	}
+	return nil
+}
+
+// serverIndex returns the position of the server at url, or -1; the lock must be held
+func (h ldapHandler) serverIndex(url string) int {
+	for k, s := range *h.servers {
+		if s.url() == url {
+			return k
+		}
+	}
+	return -1
+}
+
+func (b ldapBackend) url() string {
+	return fmt.Sprintf("%s://%s:%d", b.Scheme, b.Hostname, b.Port)
+}
+
+// CheckHealth pings all servers right away, through the monitoring goroutine,
+// and returns their resulting status
+func (h ldapHandler) CheckHealth() ([]ServerStatus, error) {
+	reply := make(chan error, 1)
+	select {
+	case h.recheck <- reply:
+	case <-h.done:
+		return nil, errors.New("server monitoring is stopped")
+	}
+	err := <-reply
+	return h.ServerStatus(), err
+}
+
+// ServerStatus returns a snapshot of the servers' health
+func (h ldapHandler) ServerStatus() []ServerStatus {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	status := make([]ServerStatus, 0, len(*h.servers))
+	for _, s := range *h.servers {
+		status = append(status, ServerStatus{
+			URL:      s.url(),
+			Up:       s.Status == Up,
+			Ping:     s.Ping,
+			Priority: s.Priority,
+			Weight:   s.Weight,
+			Health:   s.Health,
+			Draining: s.Draining,
+		})
+	}
+	return status
+}
+
+// Stop terminates the server monitoring goroutine
+func (h ldapHandler) Stop() {
+	h.stopOnce.Do(func() { close(h.done) })
+}
+
 //
-func (h ldapHandler) getSession(conn net.Conn) (ldapSession, error) {
-	id := connID(conn)
+func (h ldapHandler) getSession(conn net.Conn, userDN string) (ldapSession, error) {
+	id := sessionID(h.backend.SessionIdentity, conn)
 	h.lock.Lock()
 	s, ok := h.sessions[id] // use server connection if it exists
+	if ok {
+		atomic.AddInt32(s.inflight, 1)
+	}
 	h.lock.Unlock()
-	if !ok { // open a new server connection if not
-		var l *ldap.Conn
-		server, err := h.getBestServer() // pick the best server
+	if ok {
+		stats.Backend.Add("sessions_reused", 1)
+	} else { // open a new server connection if not
+		server, err := h.serverFor(userDN) // pick the best server, or the user's
 		if err != nil {
 			return ldapSession{}, err
 		}
-		dest := fmt.Sprintf("%s:%d", server.Hostname, server.Port)
-		if server.Scheme == "ldaps" {
-			tlsCfg := &tls.Config{}
-			if h.backend.Insecure {
-				tlsCfg.InsecureSkipVerify = true
-			}
-			l, err = ldap.DialTLS("tcp", dest, tlsCfg)
-		} else if server.Scheme == "ldap" {
-			l, err = ldap.Dial("tcp", dest)
+		l := h.standby.take(server.url())
+		if l == nil {
+			l, err = h.dial(server)
 		}
 		if err != nil {
+			stats.Backend.Add("sessions_errors", 1)
 			select {
 			case h.doPing <- true: // non-blocking send
 			default:
 			}
 			return ldapSession{}, err
 		}
-		s = ldapSession{id: id, c: conn, ldap: l}
 		h.lock.Lock()
+		// a concurrent request of the same client may have opened a session meanwhile:
+		// keep the one already in use, so that no connection is left behind unclosed
+		if existing, ok := h.sessions[id]; ok {
+			atomic.AddInt32(existing.inflight, 1)
+			h.lock.Unlock()
+			l.Close()
+			stats.Backend.Add("sessions_raced", 1)
+			return existing, nil
+		}
+		s = ldapSession{id: id, c: conn, ldap: l, server: server.url(), inflight: new(int32)}
+		*s.inflight = 1
 		h.sessions[s.id] = s
 		h.lock.Unlock()
+		stats.Backend.Add("sessions_opened", 1)
+		stats.Backend.Add("sessions_live", 1)
 	}
 	return s, nil
 }
@@ -403,37 +1066,61 @@ func (h ldapHandler) getSession(conn net.Conn) (ldapSession, error) {
 //
 func (h ldapHandler) ping() error {
 	healthy := false
-	for k, s := range h.servers {
-		var l *ldap.Conn
-		var err error
-		dest := fmt.Sprintf("%s:%d", s.Hostname, s.Port)
+	h.health.Lock()
+	defer h.health.Unlock()
+	changed := !h.health.checked
+	h.lock.Lock()
+	servers := append([]ldapBackend(nil), *h.servers...)
+	h.lock.Unlock()
+	for _, s := range servers {
 		start := time.Now()
-		if h.servers[0].Scheme == "ldaps" {
-			tlsCfg := &tls.Config{}
-			if h.backend.Insecure {
-				tlsCfg.InsecureSkipVerify = true
-			}
-			l, err = ldap.DialTLS("tcp", dest, tlsCfg)
-		} else if h.servers[0].Scheme == "ldap" {
-			l, err = ldap.Dial("tcp", dest)
-		}
+		l, err := h.dial(s)
 		elapsed := time.Since(start)
 		h.lock.Lock()
+		k := h.serverIndex(s.url())
+		if k < 0 { // removed meanwhile
+			h.lock.Unlock()
+			if l != nil {
+				l.Close()
+			}
+			continue
+		}
+		// only state transitions are logged, a sustained outage would flood the logs otherwise
 		if err != nil || l == nil {
-			h.log.Info("Server ping failed", zap.String("hostname", s.Hostname),
-				zap.Int("port", s.Port), zap.Error(err))
-			h.servers[k].Ping = 0
-			h.servers[k].Status = Down
+			if !h.health.checked || s.Status == Up {
+				h.log.Info("Server ping failed", zap.String("hostname", s.Hostname),
+					zap.Int("port", s.Port), zap.Error(err))
+				changed = true
+			}
+			(*h.servers)[k].Ping = 0
+			(*h.servers)[k].Status = Down
+			(*h.servers)[k].Health = h.smooth((*h.servers)[k].Health, 0)
 		} else {
+			if h.health.checked && s.Status == Down {
+				h.log.Info("Server ping succeeded", zap.String("hostname", s.Hostname),
+					zap.Int("port", s.Port))
+				changed = true
+			}
 			healthy = true
-			h.servers[k].Ping = elapsed
-			h.servers[k].Status = Up
+			if previous := (*h.servers)[k].Ping; previous > 0 {
+				elapsed = time.Duration(h.smooth(float64(previous), float64(elapsed)))
+			}
+			(*h.servers)[k].Ping = elapsed
+			(*h.servers)[k].Status = Up
+			(*h.servers)[k].Health = h.smooth((*h.servers)[k].Health, 1)
 			l.Close() // prank caller
 		}
 		h.lock.Unlock()
 	}
-	h.log.Info("Server health", zap.Any("servers", h.servers))
-	b, err := json.Marshal(h.servers)
+	h.health.checked = true
+	h.lock.Lock()
+	servers = append(servers[:0], *h.servers...)
+	h.lock.Unlock()
+	if changed || time.Since(h.health.logged) >= healthHeartbeat {
+		h.log.Info("Server health", zap.Any("servers", servers))
+		h.health.logged = time.Now()
+	}
+	b, err := json.Marshal(servers)
 	if err != nil {
 		h.log.Info("Error encoding tail data", zap.Error(err))
 	}
@@ -444,25 +1131,209 @@ func (h ldapHandler) ping() error {
 	return nil
 }
 
+// smooth folds the latest ping measure into an exponential moving average, weighting it
+// by the configured smoothing; without smoothing, the latest measure is kept as it is
+func (h ldapHandler) smooth(average, latest float64) float64 {
+	alpha := h.backend.HealthSmoothing
+	if alpha <= 0 || alpha >= 1 {
+		return latest
+	}
+	return alpha*latest + (1-alpha)*average
+}
+
+// usable tells whether a server may be picked: up at the last ping, healthy enough over the recent ones, and not draining
+func (h ldapHandler) usable(s ldapBackend) bool {
+	return s.Status == Up && !s.Draining && s.Health >= h.backend.HealthThreshold
+}
+
 //
 func (h ldapHandler) getBestServer() (ldapBackend, error) {
+	h.lock.Lock()
+	servers := append([]ldapBackend(nil), *h.servers...)
+	h.lock.Unlock()
+	favorite, ok := h.pickServer(servers)
+	if !ok {
+		return ldapBackend{}, fmt.Errorf("No healthy servers found")
+	}
+	h.log.Info("Best server", zap.Any("favorite", favorite))
+	h.favorite.record(h.log, fmt.Sprintf("%s:%d", favorite.Hostname, favorite.Port))
+	return favorite, nil
+}
+
+// bestPriority returns the lowest priority among usable servers, -1 when none is usable
+func (h ldapHandler) bestPriority(servers []ldapBackend) int {
+	priority := -1
+	for _, s := range servers {
+		if h.usable(s) && (priority == -1 || s.Priority < priority) {
+			priority = s.Priority
+		}
+	}
+	return priority
+}
+
+// pickServer returns the preferred server among the usable ones, if any
+func (h ldapHandler) pickServer(servers []ldapBackend) (ldapBackend, bool) {
 	favorite := ldapBackend{}
-	forever, err := time.ParseDuration("30m")
-	if err != nil {
-		return ldapBackend{}, err
+	forever := 30 * time.Minute
+	priority := h.bestPriority(servers)
+	// within that group, the latency and the configured weight of every server are both
+	// scaled against the best of the group, then blended into a score, lowest winning
+	fastest, heaviest := forever, 0
+	for _, s := range servers {
+		if h.usable(s) && s.Priority == priority {
+			if s.Ping < fastest {
+				fastest = s.Ping
+			}
+			if s.Weight > heaviest {
+				heaviest = s.Weight
+			}
+		}
 	}
-	bestping := forever
-	for _, s := range h.servers {
-		if s.Status == Up && s.Ping < bestping {
+	if fastest <= 0 {
+		fastest = time.Microsecond
+	}
+	blend := float64(h.backend.WeightBlend) / 100
+	bestscore := -1.0
+	for _, s := range servers {
+		if !h.usable(s) || s.Priority != priority {
+			continue
+		}
+		score := (1-blend)*float64(s.Ping)/float64(fastest) + blend*float64(heaviest)/float64(s.Weight)
+		if bestscore < 0 || score < bestscore {
 			favorite = s
-			bestping = s.Ping
+			bestscore = score
 		}
 	}
-	if bestping == forever {
-		return ldapBackend{}, fmt.Errorf("No healthy servers found")
+	return favorite, bestscore >= 0
+}
+
+// record notes the selected server, reporting when it differs from the previous selection
+func (f *selectedServer) record(log *zap.Logger, address string) {
+	f.Lock()
+	previous := f.address
+	f.address = address
+	f.Unlock()
+	if previous == "" || previous == address {
+		return
 	}
-	h.log.Info("Best server", zap.Any("favorite", favorite))
-	return favorite, nil
+	stats.Backend.Add("best_server_changes", 1)
+	log.Warn("Best server changed", zap.String("old", previous), zap.String("new", address))
+}
+
+// tlsConfig returns the TLS settings used to reach the backend servers. The settings
+// of the connection mode, if any, come on top of the backend-wide ones
+func (h ldapHandler) tlsConfig(settings *config.BackendTLS) (*tls.Config, error) {
+	tlsCfg := &tls.Config{}
+	insecure, skipHostname := h.backend.Insecure, h.backend.SkipHostnameVerification
+	if settings != nil {
+		insecure = insecure || settings.Insecure
+		skipHostname = skipHostname || settings.SkipHostnameVerification
+		if settings.CACert != "" {
+			pem, err := os.ReadFile(settings.CACert)
+			if err != nil {
+				return nil, err
+			}
+			tlsCfg.RootCAs = x509.NewCertPool()
+			if !tlsCfg.RootCAs.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("no certificate found in %s", settings.CACert)
+			}
+		}
+		if settings.Cert != "" || settings.Key != "" {
+			cert, err := tls.LoadX509KeyPair(settings.Cert, settings.Key)
+			if err != nil {
+				return nil, err
+			}
+			tlsCfg.Certificates = []tls.Certificate{cert}
+		}
+	}
+	if insecure {
+		tlsCfg.InsecureSkipVerify = true
+	} else if skipHostname {
+		// the standard verification is disabled, but the chain is still checked below
+		tlsCfg.InsecureSkipVerify = true
+		tlsCfg.VerifyPeerCertificate = verifyChainOnly(tlsCfg.RootCAs)
+	}
+	return tlsCfg, nil
+}
+
+// dial opens a connection to a server: TLS from the start for ldaps URLs, and for ldap
+// URLs upgraded with StartTLS when the backend configures it
+func (h ldapHandler) dial(server ldapBackend) (*ldap.Conn, error) {
+	dest := fmt.Sprintf("%s:%d", server.Hostname, server.Port)
+	if server.Scheme == "ldaps" {
+		return ldap.DialTLSDialer("tcp", dest, h.ldapsTLS, h.dialer)
+	}
+	l, err := ldap.Dial("tcp", dest)
+	if err != nil || h.startTLS == nil {
+		return l, err
+	}
+	tlsCfg := h.startTLS.Clone()
+	if tlsCfg.ServerName == "" {
+		tlsCfg.ServerName = server.Hostname
+	}
+	if err := l.StartTLS(tlsCfg); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// verifyChainOnly validates the certificate chain presented by a server against roots,
+// the system ones when nil, without checking that it was issued for the server's name
+func verifyChainOnly(roots *x509.CertPool) func([][]byte, [][]*x509.Certificate) error {
+	return func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		if len(rawCerts) == 0 {
+			return errors.New("no server certificate presented")
+		}
+		certs := make([]*x509.Certificate, len(rawCerts))
+		for i, raw := range rawCerts {
+			cert, err := x509.ParseCertificate(raw)
+			if err != nil {
+				return err
+			}
+			certs[i] = cert
+		}
+		opts := x509.VerifyOptions{Roots: roots, Intermediates: x509.NewCertPool()}
+		for _, cert := range certs[1:] {
+			opts.Intermediates.AddCert(cert)
+		}
+		_, err := certs[0].Verify(opts)
+		return err
+	}
+}
+
+// localDialer checks that a configured source address belongs to this host and
+// returns the dialer backend connections are made with.
+func localDialer(localAddr string) (*net.Dialer, error) {
+	if localAddr == "" {
+		return &net.Dialer{}, nil
+	}
+	ip := net.ParseIP(localAddr)
+	if ip == nil {
+		return nil, fmt.Errorf("%s is not an IP address", localAddr)
+	}
+	ln, err := net.ListenTCP("tcp", &net.TCPAddr{IP: ip})
+	if err != nil {
+		return nil, fmt.Errorf("cannot bind to %s: %s", localAddr, err)
+	}
+	ln.Close()
+	return &net.Dialer{LocalAddr: &net.TCPAddr{IP: ip}}, nil
+}
+
+// validateLocalAddr refuses ldap:// servers when a source address is configured:
+// the LDAP client library only accepts a net.Dialer for ldaps connections, and
+// rather than silently egressing from the wrong interface, plain and StartTLS
+// connections are not made at all.
+func (h ldapHandler) validateLocalAddr(servers []ldapBackend) error {
+	if h.backend.LocalAddr == "" {
+		return nil
+	}
+	for _, s := range servers {
+		if s.Scheme != "ldaps" {
+			return fmt.Errorf("%s: a source address can only be used with ldaps servers", s.url())
+		}
+	}
+	return nil
 }
 
 // helper functions
@@ -472,6 +1343,68 @@ func connID(conn net.Conn) string {
 	sha := fmt.Sprintf("% x", h.Sum(nil))
 	return string(sha)
 }
+
+// random identities for the "connection" session identity strategy, keyed by client connection
+var connIDs = struct {
+	sync.Mutex
+	ids map[net.Conn]string
+}{ids: make(map[net.Conn]string)}
+
+func validateSessionIdentity(strategy string) error {
+	switch strategy {
+	case "", "address", "connection":
+		return nil
+	}
+	return fmt.Errorf("Unknown session identity: %s - must be one of 'address', 'connection'", strategy)
+}
+
+func validateDegradedSearch(policy string) error {
+	switch policy {
+	case "", "error", "unavailable", "empty":
+		return nil
+	}
+	return fmt.Errorf("Unknown degraded search policy: %s - must be one of 'error', 'unavailable', 'empty'", policy)
+}
+
+// sessionID derives the key of the backend session used for a client connection.
+// "address" hashes both ends of the connection, while "connection" assigns a random
+// identity to each accepted connection so that address reuse behind NAT cannot collide.
+func sessionID(strategy string, conn net.Conn) string {
+	if strategy != "connection" {
+		return connID(conn)
+	}
+	connIDs.Lock()
+	defer connIDs.Unlock()
+	id, ok := connIDs.ids[conn]
+	if !ok {
+		b := make([]byte, 16)
+		if _, err := rand.Read(b); err != nil {
+			return connID(conn)
+		}
+		id = hex.EncodeToString(b)
+		connIDs.ids[conn] = id
+	}
+	return id
+}
+
+// forgetSessionID releases the identity assigned to a closed connection
+func forgetSessionID(conn net.Conn) {
+	connIDs.Lock()
+	delete(connIDs.ids, conn)
+	connIDs.Unlock()
+}
+func parseURLs(ldapurls []string) ([]ldapBackend, error) {
+	servers := make([]ldapBackend, 0, len(ldapurls))
+	for _, ldapurl := range ldapurls {
+		l, err := parseURL(ldapurl)
+		if err != nil {
+			return nil, err
+		}
+		servers = append(servers, l)
+	}
+	return servers, nil
+}
+
 func parseURL(ldapurl string) (ldapBackend, error) {
 	u, err := url.Parse(ldapurl)
 	if err != nil {
@@ -493,5 +1426,19 @@ func parseURL(ldapurl string) (ldapBackend, error) {
 			return ldapBackend{}, err
 		}
 	}
-	return ldapBackend{Scheme: u.Scheme, Hostname: hostname, Port: port}, nil
+	priority := 0
+	if p := u.Query().Get("priority"); p != "" {
+		priority, err = strconv.Atoi(p)
+		if err != nil || priority < 0 {
+			return ldapBackend{}, fmt.Errorf("Invalid LDAP server priority: %s", p)
+		}
+	}
+	weight := 1
+	if w := u.Query().Get("weight"); w != "" {
+		weight, err = strconv.Atoi(w)
+		if err != nil || weight < 1 {
+			return ldapBackend{}, fmt.Errorf("Invalid LDAP server weight: %s", w)
+		}
+	}
+	return ldapBackend{Scheme: u.Scheme, Hostname: hostname, Port: port, Priority: priority, Weight: weight, Health: 1}, nil
 }
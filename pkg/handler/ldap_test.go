@@ -0,0 +1,397 @@
+package handler
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/etecs-ru/glauth/v2/pkg/config"
+	"github.com/nmcclain/ldap"
+	"go.uber.org/zap"
+)
+
+// fakeDirectory is an upstream server answering searches from a fixed set of entries
+type fakeDirectory struct {
+	entries []*ldap.Entry
+	lax     bool  // answer searches under a missing base with an empty success, not noSuchObject
+	live    int32 // client connections open
+
+	mu    sync.Mutex
+	binds []string // passwords received
+}
+
+func (d *fakeDirectory) Bind(bindDN, bindSimplePw string, conn net.Conn) (ldap.LDAPResultCode, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.binds = append(d.binds, bindSimplePw)
+	return ldap.LDAPResultSuccess, nil
+}
+
+func (d *fakeDirectory) boundPasswords() []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]string(nil), d.binds...)
+}
+
+func (d *fakeDirectory) Search(boundDN string, searchReq ldap.SearchRequest, conn net.Conn) (ldap.ServerSearchResult, error) {
+	filter, err := ldap.CompileFilter(searchReq.Filter)
+	if err != nil {
+		return ldap.ServerSearchResult{ResultCode: ldap.LDAPResultOperationsError}, err
+	}
+	base := strings.ToLower(searchReq.BaseDN)
+	found := false
+	var entries []*ldap.Entry
+	for _, entry := range d.entries {
+		dn := strings.ToLower(entry.DN)
+		if dn == base {
+			found = true
+		} else if searchReq.Scope == ldap.ScopeBaseObject || !strings.HasSuffix(dn, ","+base) {
+			continue
+		}
+		if keep, _ := ldap.ServerApplyFilter(filter, entry); keep {
+			entries = append(entries, entry)
+		}
+	}
+	if !found && !d.lax {
+		return ldap.ServerSearchResult{ResultCode: ldap.LDAPResultNoSuchObject}, fmt.Errorf("no such object %s", searchReq.BaseDN)
+	}
+	return ldap.ServerSearchResult{Entries: entries, ResultCode: ldap.LDAPResultSuccess}, nil
+}
+
+// countingListener keeps track of the connections of a fakeDirectory
+type countingListener struct {
+	net.Listener
+	live *int32
+}
+
+func (l countingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	atomic.AddInt32(l.live, 1)
+	return &countedConn{Conn: conn, live: l.live}, nil
+}
+
+type countedConn struct {
+	net.Conn
+	live *int32
+	once sync.Once
+}
+
+func (c *countedConn) Close() error {
+	c.once.Do(func() { atomic.AddInt32(c.live, -1) })
+	return c.Conn.Close()
+}
+
+// startFakeDirectory serves d on a local port until the test ends, and returns its URL
+func startFakeDirectory(t *testing.T, d *fakeDirectory) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := ldap.NewServer()
+	server.BindFunc("", d)
+	server.SearchFunc("", d)
+	go server.Serve(countingListener{Listener: ln, live: &d.live})
+	t.Cleanup(func() { server.Quit <- true })
+	return "ldap://" + ln.Addr().String()
+}
+
+// newTestLdapHandler returns an LDAP backend proxying to d
+func newTestLdapHandler(t *testing.T, d *fakeDirectory, backend config.Backend, opts ...Option) ldapHandler {
+	t.Helper()
+	backend.Datastore = "ldap"
+	backend.BaseDN = "dc=example,dc=com"
+	backend.Servers = []string{startFakeDirectory(t, d)}
+	opts = append([]Option{
+		Backend(backend),
+		Logger(zap.NewNop()),
+		Config(&config.Config{}),
+	}, opts...)
+	h := NewLdapHandler(opts...).(ldapHandler)
+	t.Cleanup(h.Stop)
+	return h
+}
+
+// waitFor polls cond for up to a second, connections being closed asynchronously
+func waitFor(cond func() bool) bool {
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if cond() {
+			return true
+		}
+	}
+	return cond()
+}
+
+// benchmarkEntries builds entries as an Active Directory search for users typically returns them
+func benchmarkEntries(n int) []*ldap.Entry {
+	entries := make([]*ldap.Entry, n)
+	for i := range entries {
+		entries[i] = &ldap.Entry{
+			DN: fmt.Sprintf("cn=user%d,ou=people,dc=example,dc=com", i),
+			Attributes: []*ldap.EntryAttribute{
+				{Name: "objectClass", Values: []string{"top", "person", "organizationalPerson", "user"}},
+				{Name: "cn", Values: []string{fmt.Sprintf("user%d", i)}},
+				{Name: "sAMAccountName", Values: []string{fmt.Sprintf("user%d", i)}},
+				{Name: "mail", Values: []string{fmt.Sprintf("user%d@example.com", i)}},
+				{Name: "memberOf", Values: []string{"cn=staff,ou=groups,dc=example,dc=com"}},
+				{Name: "userAccountControl", Values: []string{"512"}},
+			},
+		}
+	}
+	return entries
+}
+
+func BenchmarkReinsertFilterAttributes(b *testing.B) {
+	h := ldapHandler{attm: ldapattributematcher}
+	filter := "(&(objectClass=user)(objectCategory=person)(|(sAMAccountName=user*)(mail=*@example.com)))"
+	requested := requestedAttributes([]string{"cn", "mail", "memberOf"}, true)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		entries := benchmarkEntries(100)
+		b.StartTimer()
+		h.reinsertFilterAttributes(h.filterAttributes(filter), requested, entries)
+	}
+}
+
+func TestReinsertFilterAttributes(t *testing.T) {
+	h := ldapHandler{attm: ldapattributematcher}
+	entry := func() *ldap.Entry {
+		return &ldap.Entry{DN: "cn=alice,dc=example,dc=com", Attributes: []*ldap.EntryAttribute{
+			{Name: "cn", Values: []string{"alice"}},
+			{Name: "description", Values: []string{}},
+		}}
+	}
+	values := func(entry *ldap.Entry, name string) []string {
+		for _, attribute := range entry.Attributes {
+			if attribute.Name == name {
+				return attribute.Values
+			}
+		}
+		return nil
+	}
+	filter := "(&(objectClass=person)(mail=alice@example.com)(description=admin))"
+
+	// attributes the backend was not asked for are the ones the filter needs back
+	filterOnly := entry()
+	h.reinsertFilterAttributes(h.filterAttributes(filter), requestedAttributes([]string{"cn"}, true), []*ldap.Entry{filterOnly})
+	if v := values(filterOnly, "objectClass"); len(v) != 1 || v[0] != "person" {
+		t.Errorf("filter-only objectClass not reinserted: %v", v)
+	}
+	if v := values(filterOnly, "mail"); len(v) != 1 || v[0] != "alice@example.com" {
+		t.Errorf("filter-only mail not reinserted: %v", v)
+	}
+
+	// requested attributes missing from the entry do not exist, whether the filter names them or not
+	requested := entry()
+	h.reinsertFilterAttributes(h.filterAttributes(filter), requestedAttributes([]string{"cn", "mail", "telephoneNumber"}, true), []*ldap.Entry{requested})
+	if v := values(requested, "mail"); v != nil {
+		t.Errorf("requested mail made up: %v", v)
+	}
+	if v := values(requested, "telephoneNumber"); v != nil {
+		t.Errorf("requested telephoneNumber made up: %v", v)
+	}
+	// present attributes stripped of their values get the asserted value back, real values are kept
+	if v := values(requested, "description"); len(v) != 1 || v[0] != "admin" {
+		t.Errorf("stripped description not filled in: %v", v)
+	}
+	if v := values(requested, "cn"); len(v) != 1 || v[0] != "alice" {
+		t.Errorf("cn changed: %v", v)
+	}
+	if len(requested.Attributes) != 3 {
+		t.Errorf("expected cn, description and objectClass only, got %d attributes", len(requested.Attributes))
+	}
+}
+
+func TestGetSessionConcurrent(t *testing.T) {
+	d := &fakeDirectory{}
+	h := newTestLdapHandler(t, d, config.Backend{})
+	conn, peer := net.Pipe()
+	defer conn.Close()
+	defer peer.Close()
+
+	const requests = 50
+	sessions := make([]ldapSession, requests)
+	var wg sync.WaitGroup
+	start := make(chan struct{})
+	for i := range sessions {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			<-start
+			s, err := h.getSession(conn, "")
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			sessions[i] = s
+		}(i)
+	}
+	close(start)
+	wg.Wait()
+
+	for _, s := range sessions {
+		if s.ldap != sessions[0].ldap {
+			t.Fatal("concurrent requests of a client got different upstream connections")
+		}
+		h.releaseSession(s)
+	}
+	h.lock.Lock()
+	open := len(h.sessions)
+	h.lock.Unlock()
+	if open != 1 {
+		t.Fatalf("expected one session, got %d", open)
+	}
+	// the connections dialed by the losers of the race are closed, the startup ping's too
+	if !waitFor(func() bool { return atomic.LoadInt32(&d.live) == 1 }) {
+		t.Fatalf("expected one upstream connection, got %d", atomic.LoadInt32(&d.live))
+	}
+}
+
+func TestSearchBinaryAttributes(t *testing.T) {
+	photo := make([]byte, 256)
+	for i := range photo {
+		photo[i] = byte(i) // NUL bytes, invalid UTF-8, upper and lower case letters
+	}
+	certificate := []byte{0x30, 0x82, 0x01, 0x0a, 0xff, 0xfe, 0x00, 'A', 'a'}
+	d := &fakeDirectory{entries: []*ldap.Entry{
+		{DN: "dc=example,dc=com"},
+		{DN: "cn=photo,dc=example,dc=com", Attributes: []*ldap.EntryAttribute{
+			{Name: "cn", Values: []string{"photo"}},
+			{Name: "jpegPhoto", Values: []string{string(photo)}},
+			{Name: "userCertificate;binary", Values: []string{string(certificate)}},
+		}},
+	}}
+	h := newTestLdapHandler(t, d, config.Backend{})
+	conn, peer := net.Pipe()
+	defer conn.Close()
+	defer peer.Close()
+
+	result, err := h.Search("", ldap.SearchRequest{
+		BaseDN:     "dc=example,dc=com",
+		Scope:      ldap.ScopeWholeSubtree,
+		Filter:     "(&(cn=photo)(userCertificate;binary=*))",
+		Attributes: []string{"cn", "jpegPhoto", "userCertificate;binary"},
+	}, conn)
+	if err != nil || len(result.Entries) != 1 {
+		t.Fatalf("search failed: %v %v", err, result.Entries)
+	}
+	got := map[string][]string{}
+	for _, attribute := range result.Entries[0].Attributes {
+		got[attribute.Name] = attribute.Values
+	}
+	if v := got["jpegPhoto"]; len(v) != 1 || v[0] != string(photo) {
+		t.Errorf("jpegPhoto altered: %q", v)
+	}
+	if v := got["userCertificate;binary"]; len(v) != 1 || v[0] != string(certificate) {
+		t.Errorf("userCertificate;binary altered: %q", v)
+	}
+	if len(got) != 3 {
+		t.Errorf("expected cn, jpegPhoto and userCertificate;binary only, got %v", got)
+	}
+}
+
+func TestBindPasswordOfOTPLength(t *testing.T) {
+	users := newTestConfigHandler(config.Backend{}, "alice", "bob")
+	// alice has an OTP, bob does not
+	users.(configHandler).cfg.Users[0].OTPSecret = "3hnvnk4ycv44glzigd6s25j4dougs3rk"
+	count := 0
+	d := &fakeDirectory{}
+	h := newTestLdapHandler(t, d, config.Backend{NameFormat: "cn"},
+		Handlers(HandlerWrapper{Handlers: []Handler{users}, Count: &count}))
+	conn, peer := net.Pipe()
+	defer conn.Close()
+	defer peer.Close()
+
+	// six characters are the token alone: stripped, the password would bind anonymously upstream
+	if code, err := h.Bind("cn=alice,dc=example,dc=com", "123456", conn); code != ldap.LDAPResultInvalidCredentials || err != nil {
+		t.Errorf("expected invalidCredentials, got %d %v", code, err)
+	}
+	if binds := d.boundPasswords(); len(binds) != 0 {
+		t.Fatalf("bind forwarded upstream with passwords %q", binds)
+	}
+	// users without OTP may well have six-character passwords
+	if code, err := h.Bind("cn=bob,dc=example,dc=com", "123456", conn); code != ldap.LDAPResultSuccess || err != nil {
+		t.Errorf("expected success, got %d %v", code, err)
+	}
+	if binds := d.boundPasswords(); len(binds) != 1 || binds[0] != "123456" {
+		t.Fatalf("expected the password of bob upstream, got %q", binds)
+	}
+}
+
+func TestMissingBaseDN(t *testing.T) {
+	entries := []*ldap.Entry{
+		{DN: "dc=example,dc=com", Attributes: []*ldap.EntryAttribute{{Name: "objectClass", Values: []string{"domain"}}}},
+		{DN: "ou=people,dc=example,dc=com", Attributes: []*ldap.EntryAttribute{{Name: "objectClass", Values: []string{"organizationalUnit"}}}},
+		{DN: "cn=alice,ou=people,dc=example,dc=com", Attributes: []*ldap.EntryAttribute{{Name: "objectClass", Values: []string{"person"}}, {Name: "cn", Values: []string{"alice"}}}},
+	}
+	search := func(h ldapHandler, baseDN string) (ldap.ServerSearchResult, error) {
+		conn, peer := net.Pipe()
+		defer conn.Close()
+		defer peer.Close()
+		return h.Search("", ldap.SearchRequest{BaseDN: baseDN, Scope: ldap.ScopeWholeSubtree, Filter: "(cn=bob)"}, conn)
+	}
+	tests := []struct {
+		name     string
+		policy   string
+		lax      bool // the upstream server answers missing bases with an empty success
+		baseDN   string
+		wantCode ldap.LDAPResultCode
+	}{
+		{"upstream noSuchObject passed on by default", "", false, "ou=missing,dc=example,dc=com", ldap.LDAPResultNoSuchObject},
+		{"upstream noSuchObject emptied", "empty", false, "ou=missing,dc=example,dc=com", ldap.LDAPResultSuccess},
+		{"upstream empty success passed on by default", "", true, "ou=missing,dc=example,dc=com", ldap.LDAPResultSuccess},
+		{"upstream empty success reported missing", "nosuchobject", true, "ou=missing,dc=example,dc=com", ldap.LDAPResultNoSuchObject},
+		{"empty result under an existing base left alone", "nosuchobject", true, "ou=people,dc=example,dc=com", ldap.LDAPResultSuccess},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newTestLdapHandler(t, &fakeDirectory{entries: entries, lax: tt.lax}, config.Backend{MissingBaseDN: tt.policy})
+			result, err := search(h, tt.baseDN)
+			if result.ResultCode != tt.wantCode {
+				t.Fatalf("expected result code %d, got %d (%v)", tt.wantCode, result.ResultCode, err)
+			}
+			// the LDAP library only sends the result code of searches failing with an error
+			if (err == nil) != (tt.wantCode == ldap.LDAPResultSuccess) {
+				t.Fatalf("unexpected error %v for result code %d", err, result.ResultCode)
+			}
+			if len(result.Entries) != 0 {
+				t.Fatalf("expected no entries, got %d", len(result.Entries))
+			}
+		})
+	}
+}
+
+func TestPassthroughBindChecksOTP(t *testing.T) {
+	users := newTestConfigHandler(config.Backend{}, "alice", "bob")
+	users.(configHandler).cfg.Users[0].OTPSecret = "3hnvnk4ycv44glzigd6s25j4dougs3rk"
+	count := 0
+	d := &fakeDirectory{}
+	h := newTestLdapHandler(t, d, config.Backend{NameFormat: "cn", NonConformingBindDN: "passthrough"},
+		Handlers(HandlerWrapper{Handlers: []Handler{users}, Count: &count}))
+	conn, peer := net.Pipe()
+	defer conn.Close()
+	defer peer.Close()
+
+	for _, name := range []string{`CORP\alice`, "alice@corp.com", "cn=alice,ou=other,dc=corp"} {
+		if code, err := h.Bind(name, "secret", conn); code != ldap.LDAPResultInvalidCredentials || err != nil {
+			t.Errorf("%s: expected invalidCredentials without OTP, got %d %v", name, code, err)
+		}
+	}
+	if binds := d.boundPasswords(); len(binds) != 0 {
+		t.Fatalf("bind forwarded upstream with passwords %q", binds)
+	}
+	// names of users without OTP, or of no known user, go upstream as they are
+	for _, name := range []string{`CORP\bob`, "carol@corp.com"} {
+		if code, err := h.Bind(name, "secret", conn); code != ldap.LDAPResultSuccess || err != nil {
+			t.Errorf("%s: expected success, got %d %v", name, code, err)
+		}
+	}
+}
@@ -10,6 +10,7 @@ import (
 	"os"
 	"path/filepath"
 	"regexp"
+	"sort"
 	"strings"
 	"time"
 
@@ -17,7 +18,6 @@ import (
 	"github.com/etecs-ru/glauth/v2/pkg/config"
 	"github.com/etecs-ru/glauth/v2/pkg/stats"
 	"github.com/nmcclain/ldap"
-	"github.com/pquerna/otp/totp"
 	"go.uber.org/zap"
 	"golang.org/x/crypto/bcrypt"
 )
@@ -61,16 +61,22 @@ func NewLDAPOpsHelper() LDAPOpsHelper {
 }
 
 func (l LDAPOpsHelper) Bind(h LDAPOpsHandler, bindDN, bindSimplePw string, conn net.Conn) (resultCode ldap.LDAPResultCode, err error) {
+	if InMaintenance() {
+		return maintenanceBindResult(h.GetCfg().Behaviors, h.GetLog(), bindDN, conn)
+	}
 	if l.isInTimeout(h, conn) {
 		return ldap.LDAPResultUnwillingToPerform, nil
 	}
 
 	bindDN = strings.ToLower(bindDN)
+	defer func() { emitBindEvent(h.GetCfg(), h.GetLog(), h.GetBackend(), bindDN, conn, resultCode) }()
+	defer func() { delayFailedBind(ConnContext(conn), h.GetCfg(), bindDN, conn, resultCode) }()
 
-	h.GetLog().Info("Bind request",
+	h.GetLog().Info("Bind request", append([]zap.Field{
 		zap.String("binddn", bindDN),
 		zap.String("basedn", h.GetBackend().BaseDN),
-		zap.String("src", conn.RemoteAddr().String()))
+		zap.String("src", conn.RemoteAddr().String())},
+		clientCertFields(conn)...)...)
 
 	stats.Frontend.Add("bind_reqs", 1)
 
@@ -86,13 +92,18 @@ func (l LDAPOpsHelper) Bind(h LDAPOpsHandler, bindDN, bindSimplePw string, conn
 		return ldapcode, nil
 	}
 
-	validotp := false
-
-	if len(user.Yubikey) == 0 && len(user.OTPSecret) == 0 {
-		validotp = true
+	if !preBindAllowed(ConnContext(conn), h.GetCfg(), h.GetLog(), h.GetBackend(), bindDN, user.Name, conn) {
+		return ldap.LDAPResultInvalidCredentials, nil
 	}
 
-	if len(user.Yubikey) > 0 && h.GetYubikeyAuth() != nil {
+	policy := otpPolicy(*user, len(user.Yubikey) > 0 || len(otpSecrets(*user)) > 0)
+	validotp := policy == config.OTPDisabled
+	grace := policy == config.OTPRequired && otpGrace(*user, h.GetCfg().Behaviors)
+
+	// users with an optional OTP may leave the token out, the password is then checked as sent
+	sentBindSimplePw := bindSimplePw
+
+	if !validotp && len(user.Yubikey) > 0 && h.GetYubikeyAuth() != nil {
 		if len(bindSimplePw) > 44 {
 			otp := bindSimplePw[len(bindSimplePw)-44:]
 			yubikeyid := otp[0:12]
@@ -113,13 +124,28 @@ func (l LDAPOpsHelper) Bind(h LDAPOpsHandler, bindDN, bindSimplePw string, conn
 	untouchedBindSimplePw := bindSimplePw
 
 	// Test OTP if is exists
-	if len(user.OTPSecret) > 0 && !validotp {
+	if len(otpSecrets(*user)) > 0 && !validotp {
 		if len(bindSimplePw) > 6 {
 			otp := bindSimplePw[len(bindSimplePw)-6:]
 			bindSimplePw = bindSimplePw[:len(bindSimplePw)-6]
 
-			validotp = totp.Validate(otp, user.OTPSecret)
+			validotp = validateOTP(otp, *user, h.GetCfg().Behaviors, h.GetLog())
+		}
+	}
+	if !validotp && grace {
+		stats.Frontend.Add("bind_otp_grace", 1)
+		// the password alone being right means the token was left out, rather than wrong
+		message := "OTP invalid, tolerated during the enrollment grace period"
+		if passwordMatches(*user, sentBindSimplePw) {
+			message = "OTP missing, tolerated during the enrollment grace period"
 		}
+		h.GetLog().Warn(message,
+			zap.String("binddn", bindDN), zap.String("src", conn.RemoteAddr().String()), zap.Time("enrolled", user.OTPEnrolled))
+		validotp, bindSimplePw = true, sentBindSimplePw
+	}
+	if !validotp && policy == config.OTPOptional {
+		stats.Frontend.Add("bind_otp_optional_skipped", 1)
+		validotp, bindSimplePw = true, sentBindSimplePw
 	}
 
 	// finally, validate user's pw
@@ -170,6 +196,13 @@ func (l LDAPOpsHelper) Bind(h LDAPOpsHandler, bindDN, bindSimplePw string, conn
 		h.GetLog().Info("invalid OTP token",
 			zap.String("binddn", bindDN),
 			zap.String("src", conn.RemoteAddr().String()))
+		// the password alone being right means the token was left out
+		if h.GetCfg().Behaviors.ReportMissingOTP && passwordMatches(*user, untouchedBindSimplePw) {
+			stats.Frontend.Add("bind_otp_missing", 1)
+			h.GetLog().Info("OTP required",
+				zap.String("binddn", bindDN),
+				zap.String("src", conn.RemoteAddr().String()))
+		}
 		return ldap.LDAPResultInvalidCredentials, nil
 	}
 
@@ -229,6 +262,9 @@ func (l LDAPOpsHelper) Search(h LDAPOpsHandler, bindDN string, searchReq ldap.Se
 	if l.isInTimeout(h, conn) {
 		return ldap.ServerSearchResult{ResultCode: ldap.LDAPResultUnwillingToPerform}, fmt.Errorf("Source is in a timeout")
 	}
+	if ldapcode, err := applyEmptyBaseDNPolicy(h.GetBackend(), &searchReq); ldapcode != ldap.LDAPResultSuccess {
+		return ldap.ServerSearchResult{ResultCode: ldapcode}, err
+	}
 
 	bindDN = strings.ToLower(bindDN)
 	baseDN := strings.ToLower(h.GetBackend().BaseDN)
@@ -245,6 +281,43 @@ func (l LDAPOpsHelper) Search(h LDAPOpsHandler, bindDN string, searchReq ldap.Se
 		}
 	}
 
+	valuesFilters, err := matchedValuesFilters(searchReq.Controls)
+	if err != nil {
+		return ldap.ServerSearchResult{ResultCode: ldap.LDAPResultProtocolError}, fmt.Errorf("Search Error: %s", err)
+	}
+	assertion, err := assertionFilter(searchReq.Controls)
+	if err != nil {
+		return ldap.ServerSearchResult{ResultCode: ldap.LDAPResultProtocolError}, fmt.Errorf("Search Error: %s", err)
+	}
+	defer func() {
+		if result.ResultCode == ldap.LDAPResultSuccess {
+			result.Entries = deduplicateEntries(h.GetBackend().DeduplicateEntries, result.Entries)
+			applyFixedAttributes(h.GetBackend().FixedAttributes, h.GetBackend().BaseDN, result.Entries)
+			applyEntryUUIDs(h.GetBackend(), searchReq, result.Entries)
+			applyAttributeTransforms(h.GetBackend().AttributeTransforms, result.Entries)
+			result.Entries = applyMatchedValues(result.Entries, valuesFilters, searchReq.Filter)
+			if len(valuesFilters) > 0 {
+				result.Controls = markFilterMatched(result.Controls)
+			}
+			if h.GetBackend().SortEntries {
+				sortEntries(result.Entries)
+			}
+		}
+	}()
+
+	// the assertion applies to the base entry whatever the scope and filter, which may leave it
+	// out of the results: it is looked up on its own, as a base search would return it
+	defer func() {
+		if result.ResultCode != ldap.LDAPResultSuccess || assertion == nil {
+			return
+		}
+		target, _ := l.Search(h, bindDN, ldap.SearchRequest{BaseDN: searchReq.BaseDN, Scope: ldap.ScopeBaseObject, Filter: "(objectClass=*)"}, conn)
+		if !assertionHolds(assertion, target.Entries, searchReq.BaseDN) {
+			result = ldap.ServerSearchResult{ResultCode: LDAPResultAssertionFailed}
+			err = fmt.Errorf("Search Error: assertion failed on %s", searchReq.BaseDN)
+		}
+	}()
+
 	h.GetLog().Info("Search request",
 		zap.String("binddn", bindDN),
 		zap.String("src", conn.RemoteAddr().String()),
@@ -335,9 +408,10 @@ func (l LDAPOpsHelper) searchCheckBindDN(h LDAPOpsHandler, baseDN string, bindDN
 	// What if this user was bound using their UPN? We still want to enforce baseDN etc so we
 	// have to rewire them to their original DN which is of course a waste of cycles.
 	// TODO Down the road we would want to perform lightweight memoization of DNs to UPNs
-	if emailmatcher.MatchString(bindDN) {
+	// The same goes for bare and DOMAIN\user names.
+	if _, ok := bindNameUser(h.GetBackend().BindNameForms, bindDN); ok || emailmatcher.MatchString(bindDN) {
 		// cn=serviceuser,ou=svcaccts,dc=glauth,dc=com
-		bindDN = fmt.Sprintf("cn=%s,%s", boundUser.Name, baseDN)
+		bindDN = fmt.Sprintf("%s=%s,%s", h.GetBackend().NameFormat, boundUser.Name, baseDN)
 	}
 	return bindDN, boundUser, ldap.LDAPResultSuccess
 }
@@ -364,7 +438,7 @@ func (l LDAPOpsHelper) searchMaybeRootDSEQuery(h LDAPOpsHandler, baseDN string,
 	// attrs = append(attrs, &ldap.EntryAttribute{Name: "objectClass", Values: []string{"*"}})
 	attrs = append(attrs, &ldap.EntryAttribute{Name: "supportedSASLMechanisms", Values: []string{}})
 	attrs = append(attrs, &ldap.EntryAttribute{Name: "supportedLDAPVersion", Values: []string{"3"}})
-	attrs = append(attrs, &ldap.EntryAttribute{Name: "supportedControl", Values: []string{}})
+	attrs = append(attrs, &ldap.EntryAttribute{Name: "supportedControl", Values: []string{ControlTypeMatchedValues, ControlTypeAssertion}})
 	attrs = append(attrs, &ldap.EntryAttribute{Name: "supportedCapabilities", Values: []string{}})
 	attrs = append(attrs, &ldap.EntryAttribute{Name: "subschemaSubentry", Values: []string{"cn=schema"}})
 	attrs = append(attrs, &ldap.EntryAttribute{Name: "serverName", Values: []string{"unknown"}})
@@ -388,6 +462,7 @@ func (l LDAPOpsHelper) searchMaybeSchemaQuery(h LDAPOpsHandler, baseDN string, s
 	var entries []*ldap.Entry
 	var attrs []*ldap.EntryAttribute
 	attrs = append(attrs, &ldap.EntryAttribute{Name: "cn", Values: []string{"schema"}})
+	attrs = append(attrs, &ldap.EntryAttribute{Name: "objectClass", Values: []string{"top", "subschema"}})
 	attrs = append(attrs, &ldap.EntryAttribute{Name: "hasSubordinates", Values: []string{"false"}})
 	attrs = append(attrs, &ldap.EntryAttribute{Name: "modifiersName", Values: []string{"cn=Directory Manager"}})
 	attrs = append(attrs, &ldap.EntryAttribute{Name: "modifyTimeStamp", Values: []string{"Mar 8, 2021, 12:46:29 PM PST (20210308204629Z)"}})
@@ -409,6 +484,13 @@ func (l LDAPOpsHelper) searchMaybeSchemaQuery(h LDAPOpsHandler, baseDN string, s
 		}
 		attrs = append(attrs, &ldap.EntryAttribute{Name: filename.Name(), Values: values})
 	}
+	// fall back to the built-in definitions of what we return
+	if !hasAttribute(attrs, "attributeTypes") {
+		attrs = append(attrs, &ldap.EntryAttribute{Name: "attributeTypes", Values: defaultAttributeTypes})
+	}
+	if !hasAttribute(attrs, "objectClasses") {
+		attrs = append(attrs, &ldap.EntryAttribute{Name: "objectClasses", Values: defaultObjectClasses})
+	}
 	attrs = l.collectRequestedAttributesBack(attrs, searchReq)
 	entries = append(entries, &ldap.Entry{DN: searchBaseDN, Attributes: attrs})
 	stats.Frontend.Add("search_successes", 1)
@@ -623,6 +705,14 @@ func (l LDAPOpsHelper) findUser(h LDAPOpsHandler, bindDN string, checkGroup bool
 			h.GetLog().Info("User not found", zap.String("userprincipalname", bindDN))
 			return nil, ldap.LDAPResultInvalidCredentials
 		}
+	} else if userName, ok := bindNameUser(h.GetBackend().BindNameForms, bindDN); ok {
+		// Special Case: bind using a bare or DOMAIN\user name, which names no group
+		var foundUser bool // = false
+		foundUser, user, _ = h.FindUser(userName, false)
+		if !foundUser {
+			h.GetLog().Info("User not found", zap.String("username", userName))
+			return nil, ldap.LDAPResultInvalidCredentials
+		}
 	} else {
 		// parse the bindDN - ensure that the bindDN ends with the BaseDN
 		if !strings.HasSuffix(bindDN, baseDN) {
@@ -685,6 +775,13 @@ func (l LDAPOpsHelper) findUser(h LDAPOpsHandler, bindDN string, checkGroup bool
 	return &user, ldap.LDAPResultSuccess
 }
 
+// sortEntries orders entries by DN, case-insensitively, for stable results
+func sortEntries(entries []*ldap.Entry) {
+	sort.SliceStable(entries, func(i, j int) bool {
+		return strings.ToLower(entries[i].DN) < strings.ToLower(entries[j].DN)
+	})
+}
+
 // TODO Modify when resolved https://github.com/glauth/glauth/issues/246
 func checkParts(parts []string) bool {
 	return len(parts) == 3 && parts[2] == "ou=users"
@@ -799,3 +896,32 @@ func (l LDAPOpsHelper) getAddr(conn net.Conn) string {
 	}
 	return fullAddr[0:sep]
 }
+
+func hasAttribute(attrs []*ldap.EntryAttribute, name string) bool {
+	for _, attr := range attrs {
+		if strings.EqualFold(attr.Name, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// passwordMatches tells whether pw is the user's password, as opposed to an app password
+func passwordMatches(user config.User, pw string) bool {
+	if user.PassBcrypt == "" && user.PassSHA256 == "" {
+		return false
+	}
+	if user.PassBcrypt != "" {
+		decoded, err := hex.DecodeString(user.PassBcrypt)
+		if err != nil || bcrypt.CompareHashAndPassword(decoded, []byte(pw)) != nil {
+			return false
+		}
+	}
+	if user.PassSHA256 != "" {
+		hash := sha256.Sum256([]byte(pw))
+		if user.PassSHA256 != hex.EncodeToString(hash[:]) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,123 @@
+package handler
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"io"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/nmcclain/ldap"
+)
+
+// ldifLineLength is the length past which LDIF lines are folded (RFC 2849 recommends 76)
+const ldifLineLength = 76
+
+// ExportLDIF writes the entries of a config backend as an LDIF file (RFC 2849), as a subtree
+// search of its base DN, fixed attributes and transforms included, would return them, plus
+// the groups under ou=groups. Parents come before their children, so that the file can be
+// imported into another directory. Password hashes are left out unless passwords is set, in
+// which case they are written as userPassword, in the {CRYPT} and {SHA256} schemes.
+func ExportLDIF(w io.Writer, h Handler, passwords bool) error {
+	oh, ok := h.(LDAPOpsHandler)
+	if !ok {
+		return errors.New("LDIF export: the backend does not hold its own entries")
+	}
+	backend := oh.GetBackend()
+	baseDN := backend.BaseDN
+	l := LDAPOpsHelper{}
+
+	accounts, err := oh.FindPosixAccounts("ou=users")
+	if err != nil {
+		return err
+	}
+	if passwords {
+		// one entry per configured user, in order
+		for i, u := range oh.GetCfg().Users {
+			if i < len(accounts) {
+				if values := userPasswords(u.PassBcrypt, u.PassSHA256); len(values) > 0 {
+					accounts[i].Attributes = append(accounts[i].Attributes, &ldap.EntryAttribute{Name: "userPassword", Values: values})
+				}
+			}
+		}
+	}
+	groups, err := oh.FindPosixGroups("ou=groups")
+	if err != nil {
+		return err
+	}
+	userGroups, err := oh.FindPosixGroups("ou=users")
+	if err != nil {
+		return err
+	}
+	entries := []*ldap.Entry{l.topLevelRootNode(baseDN), l.topLevelGroupsNode(baseDN, "groups"), l.topLevelUsersNode(baseDN)}
+	entries = append(entries, groups...)
+	entries = append(entries, userGroups...)
+	entries = append(entries, accounts...)
+	applyFixedAttributes(backend.FixedAttributes, baseDN, entries)
+	applyAttributeTransforms(backend.AttributeTransforms, entries)
+	if backend.SortEntries {
+		sortEntries(entries)
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		return strings.Count(entries[i].DN, ",") < strings.Count(entries[j].DN, ",")
+	})
+
+	out := bufio.NewWriter(w)
+	out.WriteString("version: 1\n")
+	for _, entry := range entries {
+		out.WriteString("\n")
+		writeLDIFLine(out, "dn", entry.DN)
+		for _, attr := range entry.Attributes {
+			for _, value := range attr.Values {
+				writeLDIFLine(out, attr.Name, value)
+			}
+		}
+	}
+	return out.Flush()
+}
+
+// userPasswords returns the userPassword values of a user's password hashes
+func userPasswords(passBcrypt, passSHA256 string) []string {
+	values := []string{}
+	if decoded, err := hex.DecodeString(passBcrypt); err == nil && len(decoded) > 0 {
+		values = append(values, "{CRYPT}"+string(decoded))
+	}
+	if decoded, err := hex.DecodeString(passSHA256); err == nil && len(decoded) > 0 {
+		values = append(values, "{SHA256}"+base64.StdEncoding.EncodeToString(decoded))
+	}
+	return values
+}
+
+// writeLDIFLine writes an attribute value, base64 encoded when it is not a safe string, and
+// folded into lines of ldifLineLength
+func writeLDIFLine(out *bufio.Writer, name, value string) {
+	line := name + ": " + value
+	if !ldifSafe(value) {
+		line = name + ":: " + base64.StdEncoding.EncodeToString([]byte(value))
+	}
+	for len(line) > ldifLineLength {
+		out.WriteString(line[:ldifLineLength] + "\n ")
+		line = line[ldifLineLength:]
+	}
+	out.WriteString(line + "\n")
+}
+
+// ldifSafe tells whether a value can be written as is: printable ASCII, not starting with a
+// space, colon or less-than sign, nor ending with a space
+func ldifSafe(value string) bool {
+	if value == "" {
+		return true
+	}
+	if value[0] == ' ' || value[0] == ':' || value[0] == '<' || value[len(value)-1] == ' ' {
+		return false
+	}
+	for i := 0; i < len(value); i++ {
+		if value[i] < 0x20 || value[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,55 @@
+package handler
+
+import (
+	"net"
+	"sync/atomic"
+
+	"github.com/etecs-ru/glauth/v2/pkg/config"
+	"github.com/etecs-ru/glauth/v2/pkg/stats"
+	"github.com/nmcclain/ldap"
+	"go.uber.org/zap"
+)
+
+// maintenance is shared by all handlers: while set, new binds are refused
+// but existing sessions keep working
+var maintenance int32
+
+// SetMaintenance enables or disables maintenance mode at runtime
+func SetMaintenance(enabled bool) {
+	var v int32
+	if enabled {
+		v = 1
+	}
+	atomic.StoreInt32(&maintenance, v)
+	stats.General.Set("maintenance", stats.Stringer(maintenanceState(enabled)))
+}
+
+// InMaintenance reports whether maintenance mode is currently enabled
+func InMaintenance() bool {
+	return atomic.LoadInt32(&maintenance) == 1
+}
+
+// maintenanceBindResult returns the result code configured for binds refused in maintenance mode.
+// The LDAP library sends bind responses without diagnostic text, so the configured message
+// is only logged here: an error would turn the response into operationsError.
+func maintenanceBindResult(behaviors config.Behaviors, log *zap.Logger, bindDN string, conn net.Conn) (ldap.LDAPResultCode, error) {
+	stats.Frontend.Add("bind_maintenance_rejections", 1)
+	resultCode := ldap.LDAPResultCode(ldap.LDAPResultUnavailable)
+	if behaviors.MaintenanceResultCode != 0 {
+		resultCode = ldap.LDAPResultCode(behaviors.MaintenanceResultCode)
+	}
+	message := "under maintenance"
+	if behaviors.MaintenanceMessage != "" {
+		message = behaviors.MaintenanceMessage
+	}
+	log.Info("Bind refused: maintenance mode", zap.String("binddn", bindDN), zap.String("src", conn.RemoteAddr().String()),
+		zap.String("message", message), zap.Int("resultcode", int(resultCode)))
+	return resultCode, nil
+}
+
+func maintenanceState(enabled bool) string {
+	if enabled {
+		return "on"
+	}
+	return "off"
+}
@@ -0,0 +1,123 @@
+package handler
+
+import (
+	"errors"
+	"strings"
+
+	ber "github.com/nmcclain/asn1-ber"
+	"github.com/nmcclain/ldap"
+)
+
+// ControlTypeMatchedValues is the OID of the matched values control (RFC 3876)
+const ControlTypeMatchedValues = "1.2.826.0.1.3344810.2.3"
+
+// valuesFilter is one item of a matched values control's ValuesReturnFilter
+type valuesFilter struct {
+	attribute string // lowercased
+	packet    *ber.Packet
+}
+
+// matchedValuesFilters decodes the ValuesReturnFilter of a matched values control, if any
+func matchedValuesFilters(controls []ldap.Control) ([]valuesFilter, error) {
+	control := ldap.FindControl(controls, ControlTypeMatchedValues)
+	if control == nil {
+		return nil, nil
+	}
+	cs, ok := control.(*ldap.ControlString)
+	if !ok {
+		return nil, errors.New("unexpected matched values control encoding")
+	}
+	packet := ber.DecodePacket([]byte(cs.ControlValue))
+	if packet == nil {
+		return nil, errors.New("invalid matched values control value")
+	}
+	filters := []valuesFilter{}
+	for _, item := range packet.Children {
+		f, err := ldap.DecompileFilter(item)
+		if err != nil {
+			return nil, err
+		}
+		// simple items look like (attr=value), (attr>=value), (attr~=value), (attr=*)...
+		end := strings.IndexAny(f, "=~<>:")
+		if !strings.HasPrefix(f, "(") || end < 2 {
+			return nil, errors.New("unsupported matched values filter item " + f)
+		}
+		filters = append(filters, valuesFilter{attribute: strings.ToLower(f[1:end]), packet: item})
+	}
+	return filters, nil
+}
+
+// controlTypeFilterMatched marks the results of backends that matched the search filter
+// themselves before trimming values for a matched values control. It is never sent: the
+// frontend takes it off the results, and only skips matching the filter again when present.
+const controlTypeFilterMatched = "glauth.filterMatched"
+
+// markFilterMatched adds the mark of results whose entries were matched before being trimmed
+func markFilterMatched(controls []ldap.Control) []ldap.Control {
+	return append(controls, ldap.NewControlString(controlTypeFilterMatched, false, ""))
+}
+
+// takeFilterMatched takes the mark off result controls and tells whether it was there
+func takeFilterMatched(controls []ldap.Control) ([]ldap.Control, bool) {
+	for i, control := range controls {
+		if control.GetControlType() == controlTypeFilterMatched {
+			return append(controls[:i:i], controls[i+1:]...), true
+		}
+	}
+	return controls, false
+}
+
+// applyMatchedValues drops the entries not matching the search filter, then only keeps the
+// values matching at least one filter item. The filter has to be matched first, as trimmed
+// values may no longer satisfy it; results must then carry markFilterMatched for the frontend
+// not to match it again.
+func applyMatchedValues(entries []*ldap.Entry, filters []valuesFilter, searchFilter string) []*ldap.Entry {
+	if len(filters) == 0 {
+		return entries
+	}
+	if packet, err := ldap.CompileFilter(searchFilter); err == nil {
+		matching := entries[:0]
+		for _, entry := range entries {
+			if ok, _ := ldap.ServerApplyFilter(packet, filterView(entry)); ok {
+				matching = append(matching, entry)
+			}
+		}
+		entries = matching
+	}
+	trimMatchedValues(entries, filters)
+	return entries
+}
+
+// trimMatchedValues only keeps, in the attributes some filter item names, the values matching
+// at least one of those items. Attributes no filter item names are left whole (RFC 3876).
+// Trimmed attributes are replaced rather than changed, as backends may hold on to them.
+func trimMatchedValues(entries []*ldap.Entry, filters []valuesFilter) {
+	if len(filters) == 0 {
+		return
+	}
+	for _, entry := range entries {
+		for i, attribute := range entry.Attributes {
+			name := strings.ToLower(strings.TrimPrefix(attribute.Name, "+"))
+			var applicable []valuesFilter
+			for _, f := range filters {
+				if f.attribute == name {
+					applicable = append(applicable, f)
+				}
+			}
+			if len(applicable) == 0 {
+				continue
+			}
+			kept := []string{}
+			for _, value := range attribute.Values {
+				single := &ldap.Entry{Attributes: []*ldap.EntryAttribute{{Name: name, Values: []string{value}}}}
+				for _, f := range applicable {
+					if ok, _ := ldap.ServerApplyFilter(f.packet, single); ok {
+						kept = append(kept, value)
+						break
+					}
+				}
+			}
+			entry.Attributes[i] = &ldap.EntryAttribute{Name: attribute.Name, Values: kept}
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package handler
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/etecs-ru/glauth/v2/pkg/config"
+)
+
+const (
+	memoryFirstUID = 10000
+	memoryFirstGID = 5000
+)
+
+// NewMemoryHandler creates a handler serving a synthetic set of users and groups from RAM.
+// It performs no I/O at all, which makes it suitable for measuring GLAuth's own overhead.
+// Every synthetic user's password is their own name.
+func NewMemoryHandler(opts ...Option) Handler {
+	options := newOptions(opts...)
+
+	cfg := config.Config{}
+	if options.Config != nil {
+		cfg = *options.Config
+	}
+	cfg.Users, cfg.Groups = memoryDirectory(options.Backend.MemoryUsers, options.Backend.MemoryGroups)
+
+	return NewConfigHandler(
+		Backend(options.Backend),
+		Logger(options.Logger),
+		Config(&cfg),
+		YubiAuth(options.YubiAuth),
+		LDAPHelper(options.LDAPHelper),
+	)
+}
+
+// memoryDirectory generates users user0..userN spread round-robin over groups group0..groupN
+func memoryDirectory(numUsers, numGroups int) ([]config.User, []config.Group) {
+	if numGroups < 1 {
+		numGroups = 1
+	}
+	groups := make([]config.Group, 0, numGroups)
+	for i := 0; i < numGroups; i++ {
+		groups = append(groups, config.Group{
+			Name:      fmt.Sprintf("group%d", i),
+			GIDNumber: memoryFirstGID + i,
+		})
+	}
+	users := make([]config.User, 0, numUsers)
+	for i := 0; i < numUsers; i++ {
+		name := fmt.Sprintf("user%d", i)
+		hash := sha256.Sum256([]byte(name))
+		users = append(users, config.User{
+			Name:         name,
+			UIDNumber:    memoryFirstUID + i,
+			PrimaryGroup: memoryFirstGID + i%numGroups,
+			PassSHA256:   hex.EncodeToString(hash[:]),
+			Mail:         name + "@example.com",
+			Capabilities: []config.Capability{{Action: "search", Object: "*"}},
+		})
+	}
+	return users, groups
+}
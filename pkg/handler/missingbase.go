@@ -0,0 +1,45 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/etecs-ru/glauth/v2/pkg/stats"
+	"github.com/nmcclain/ldap"
+	"go.uber.org/zap"
+)
+
+func validateMissingBaseDN(policy string) error {
+	switch policy {
+	case "", "empty", "nosuchobject":
+		return nil
+	}
+	return fmt.Errorf("Unknown missing base DN policy: %s - must be one of 'empty', 'nosuchobject'", policy)
+}
+
+// missingBaseResult applies the backend's policy for search bases missing upstream:
+// "empty" answers noSuchObject with an empty success, while "nosuchobject" checks, when a
+// search comes back empty, that its base exists, and answers noSuchObject if it does not
+func (h ldapHandler) missingBaseResult(ctx context.Context, s ldapSession, baseDN string, sr *ldap.SearchResult, err error) (*ldap.SearchResult, error) {
+	switch h.backend.MissingBaseDN {
+	case "empty":
+		if e, ok := err.(*ldap.Error); ok && e.ResultCode == ldap.LDAPResultNoSuchObject {
+			stats.Frontend.Add("search_missing_base_emptied", 1)
+			h.log.Info("Search base missing upstream, answered as empty", zap.String("basedn", baseDN))
+			return &ldap.SearchResult{}, nil
+		}
+	case "nosuchobject":
+		if err != nil || (sr != nil && len(sr.Entries) > 0) {
+			break
+		}
+		check := ldap.NewSearchRequest(baseDN, ldap.ScopeBaseObject, ldap.NeverDerefAliases, 1, 0, false, "(objectClass=*)", []string{"1.1"}, nil)
+		found, cerr := h.searchWithDeadline(ctx, s, check)
+		if e, ok := cerr.(*ldap.Error); (ok && e.ResultCode == ldap.LDAPResultNoSuchObject) || (cerr == nil && (found == nil || len(found.Entries) == 0)) {
+			stats.Frontend.Add("search_missing_base_reported", 1)
+			h.log.Info("Search base missing upstream, answered as noSuchObject", zap.String("basedn", baseDN))
+			return sr, ldap.NewError(ldap.LDAPResultNoSuchObject, errors.New("Search Error: no such object "+baseDN))
+		}
+	}
+	return sr, err
+}
@@ -65,7 +65,7 @@ func (h ownCloudHandler) Bind(bindDN, bindSimplePw string, conn net.Conn) (ldap.
 	}
 
 	// TODO reuse HTTP connection
-	id := connID(conn)
+	id := sessionID(h.backend.SessionIdentity, conn)
 	s := ownCloudSession{
 		log:         h.log,
 		user:        userName,
@@ -111,7 +111,7 @@ func (h ownCloudHandler) Search(bindDN string, searchReq ldap.SearchRequest, con
 		return ldap.ServerSearchResult{ResultCode: ldap.LDAPResultOperationsError}, fmt.Errorf("search error: error parsing filter: %s", searchReq.Filter)
 	}
 	h.lock.Lock()
-	id := connID(conn)
+	id := sessionID(h.backend.SessionIdentity, conn)
 	session := h.sessions[id]
 	h.lock.Unlock()
 
@@ -178,17 +178,17 @@ func (h ownCloudHandler) Search(bindDN string, searchReq ldap.SearchRequest, con
 
 // Add is not yet supported for the owncloud backend
 func (h ownCloudHandler) Add(boundDN string, req ldap.AddRequest, conn net.Conn) (result ldap.LDAPResultCode, err error) {
-	return ldap.LDAPResultInsufficientAccessRights, nil
+	return writeResult(h.backend, "add")
 }
 
 // Modify is not yet supported for the owncloud backend
 func (h ownCloudHandler) Modify(boundDN string, req ldap.ModifyRequest, conn net.Conn) (result ldap.LDAPResultCode, err error) {
-	return ldap.LDAPResultInsufficientAccessRights, nil
+	return writeResult(h.backend, "modify")
 }
 
 // Delete is not yet supported for the owncloud backend
 func (h ownCloudHandler) Delete(boundDN string, deleteDN string, conn net.Conn) (result ldap.LDAPResultCode, err error) {
-	return ldap.LDAPResultInsufficientAccessRights, nil
+	return writeResult(h.backend, "delete")
 }
 
 // FindUser with the given username. Called by the ldap backend to authenticate the bind. Optional
@@ -204,7 +204,8 @@ func (h ownCloudHandler) Close(boundDN string, conn net.Conn) error {
 	conn.Close() // close connection to the server when then client is closed
 	h.lock.Lock()
 	defer h.lock.Unlock()
-	delete(h.sessions, connID(conn))
+	delete(h.sessions, sessionID(h.backend.SessionIdentity, conn))
+	forgetSessionID(conn)
 	stats.Frontend.Add("closes", 1)
 	stats.Backend.Add("closes", 1)
 	return nil
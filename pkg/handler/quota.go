@@ -0,0 +1,155 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/etecs-ru/glauth/v2/pkg/config"
+	"github.com/etecs-ru/glauth/v2/pkg/stats"
+	"github.com/nmcclain/ldap"
+	"go.uber.org/zap"
+)
+
+type quotaUse struct {
+	ts      time.Time
+	entries int
+}
+
+// entryQuotas keeps, per bound identity, the entries returned during the current rolling window
+type entryQuotas struct {
+	sync.Mutex
+	uses        map[string][]quotaUse
+	nextPruning time.Time // when identities without use in the window are next forgotten
+}
+
+var quotas = entryQuotas{uses: make(map[string][]quotaUse)}
+
+// entryQuotaLimit returns the entry quota applying to a user: their own, then their
+// primary group's, then the global one. Zero or less means unlimited.
+func entryQuotaLimit(cfg *config.Config, user *config.User) int {
+	if user != nil {
+		if user.EntryQuota != 0 {
+			return user.EntryQuota
+		}
+		for _, g := range cfg.Groups {
+			if g.GIDNumber == user.PrimaryGroup && g.EntryQuota != 0 {
+				return g.EntryQuota
+			}
+		}
+	}
+	return cfg.Behaviors.EntryQuota
+}
+
+// consumeEntryQuota records entries returned to identity and reports whether it stays within limit
+func consumeEntryQuota(cfg *config.Config, identity string, limit int, entries int) bool {
+	if limit <= 0 || entries == 0 {
+		return true
+	}
+	window := cfg.Behaviors.EntryQuotaWindow * time.Second
+	if window <= 0 {
+		window = 60 * time.Second
+	}
+	identity = strings.ToLower(identity)
+	now := time.Now()
+
+	quotas.Lock()
+	defer quotas.Unlock()
+	used := 0
+	kept := quotas.uses[identity][:0]
+	for _, u := range quotas.uses[identity] {
+		if u.ts.Add(window).After(now) {
+			kept = append(kept, u)
+			used += u.entries
+		}
+	}
+	if quotas.nextPruning.Before(now) {
+		quotas.prune(now, window)
+		quotas.nextPruning = now.Add(window)
+	}
+	if used+entries > limit {
+		if len(kept) == 0 {
+			delete(quotas.uses, identity)
+		} else {
+			quotas.uses[identity] = kept
+		}
+		return false
+	}
+	quotas.uses[identity] = append(kept, quotaUse{ts: now, entries: entries})
+	return true
+}
+
+// prune forgets the identities without use in the current window, the lock must be held
+func (q *entryQuotas) prune(now time.Time, window time.Duration) {
+	for identity, uses := range q.uses {
+		if len(uses) == 0 || !uses[len(uses)-1].ts.Add(window).After(now) {
+			delete(q.uses, identity)
+		}
+	}
+}
+
+// entryQuotaHandler charges the entries of search results, as sent to the client, to the
+// entry quota of the bound identity
+type entryQuotaHandler struct {
+	Handler
+	handlers HandlerWrapper
+	cfg      *config.Config
+	log      *zap.Logger
+}
+
+// WithEntryQuota wraps a handler so that searches returning more entries than the bound
+// identity has left in its quota are refused. It goes outside WithSearchChecks, so that
+// entries the filter, scope or size limit leave out are not charged.
+func WithEntryQuota(h Handler, handlers HandlerWrapper, cfg *config.Config, log *zap.Logger) Handler {
+	return entryQuotaHandler{Handler: h, handlers: handlers, cfg: cfg, log: log}
+}
+
+func (q entryQuotaHandler) Bind(bindDN, bindSimplePw string, conn net.Conn) (ldap.LDAPResultCode, error) {
+	return q.BindContext(ConnContext(conn), bindDN, bindSimplePw, conn)
+}
+
+func (q entryQuotaHandler) BindContext(ctx context.Context, bindDN, bindSimplePw string, conn net.Conn) (ldap.LDAPResultCode, error) {
+	return searchOrBind{q.Handler}.bind(ctx, bindDN, bindSimplePw, conn)
+}
+
+func (q entryQuotaHandler) Search(boundDN string, searchReq ldap.SearchRequest, conn net.Conn) (ldap.ServerSearchResult, error) {
+	return q.SearchContext(ConnContext(conn), boundDN, searchReq, conn)
+}
+
+func (q entryQuotaHandler) SearchContext(ctx context.Context, boundDN string, searchReq ldap.SearchRequest, conn net.Conn) (ldap.ServerSearchResult, error) {
+	result, err := searchOrBind{q.Handler}.search(ctx, boundDN, searchReq, conn)
+	if err != nil || result.ResultCode != ldap.LDAPResultSuccess || boundDN == "" {
+		return result, err
+	}
+	// the same user bound by DN, UPN or DOMAIN\user shares one quota
+	identity := boundDN
+	var user *config.User
+	if found, u := q.findUser(passthroughUserName(strings.ToLower(boundDN))); found {
+		identity, user = u.Name, &u
+	}
+	if consumeEntryQuota(q.cfg, identity, entryQuotaLimit(q.cfg, user), len(result.Entries)) {
+		return result, nil
+	}
+	stats.Frontend.Add("search_quota_exceeded", 1)
+	q.log.Warn("Search refused: entry quota exceeded",
+		zap.String("binddn", boundDN),
+		zap.String("src", conn.RemoteAddr().String()),
+		zap.Int("numentries", len(result.Entries)))
+	return ldap.ServerSearchResult{ResultCode: ldap.LDAPResultAdminLimitExceeded}, fmt.Errorf("Search Error: entry quota exceeded for %s", boundDN)
+}
+
+// findUser asks the backends in turn for the user called userName
+func (q entryQuotaHandler) findUser(userName string) (bool, config.User) {
+	for i, h := range q.handlers.Handlers {
+		if i > *q.handlers.Count {
+			break
+		}
+		if found, user, _ := h.FindUser(userName, false); found {
+			return true, user
+		}
+	}
+	return false, config.User{}
+}
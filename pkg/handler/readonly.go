@@ -0,0 +1,42 @@
+package handler
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/etecs-ru/glauth/v2/pkg/stats"
+	"github.com/nmcclain/ldap"
+)
+
+// readOnlyHandler refuses every write, whatever the wrapped handler would do with it
+type readOnlyHandler struct {
+	Handler
+	resultCode ldap.LDAPResultCode
+}
+
+// WithReadOnly wraps a handler so that Add, Modify and Delete are answered with resultCode,
+// insufficient access rights when zero, without ever reaching a backend
+func WithReadOnly(h Handler, resultCode int) Handler {
+	r := readOnlyHandler{Handler: h, resultCode: ldap.LDAPResultInsufficientAccessRights}
+	if resultCode != 0 {
+		r.resultCode = ldap.LDAPResultCode(resultCode)
+	}
+	return r
+}
+
+func (r readOnlyHandler) Add(boundDN string, req ldap.AddRequest, conn net.Conn) (ldap.LDAPResultCode, error) {
+	return r.refuse("add")
+}
+
+func (r readOnlyHandler) Modify(boundDN string, req ldap.ModifyRequest, conn net.Conn) (ldap.LDAPResultCode, error) {
+	return r.refuse("modify")
+}
+
+func (r readOnlyHandler) Delete(boundDN, deleteDN string, conn net.Conn) (ldap.LDAPResultCode, error) {
+	return r.refuse("delete")
+}
+
+func (r readOnlyHandler) refuse(operation string) (ldap.LDAPResultCode, error) {
+	stats.Frontend.Add(operation+"_readonly_rejections", 1)
+	return r.resultCode, fmt.Errorf("%s refused: server is read-only", operation)
+}
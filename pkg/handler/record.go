@@ -0,0 +1,260 @@
+package handler
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/etecs-ru/glauth/v2/pkg/config"
+	"github.com/etecs-ru/glauth/v2/pkg/stats"
+	"github.com/nmcclain/ldap"
+	"go.uber.org/zap"
+)
+
+// recordedOperation is one line of a recording: a request and the response it got.
+// Passwords are only ever stored hashed.
+type recordedOperation struct {
+	Operation  string   `json:"operation"`
+	BoundDN    string   `json:"bounddn,omitempty"`
+	DN         string   `json:"dn,omitempty"`
+	Password   string   `json:"password,omitempty"`
+	BaseDN     string   `json:"basedn,omitempty"`
+	Scope      int      `json:"scope,omitempty"`
+	Filter     string   `json:"filter,omitempty"`
+	Attributes []string `json:"attributes,omitempty"`
+	Request    string   `json:"request,omitempty"` // add and modify requests, as printed
+
+	ResultCode int           `json:"resultcode"`
+	Error      string        `json:"error,omitempty"`
+	Entries    []*ldap.Entry `json:"entries,omitempty"`
+	Referrals  []string      `json:"referrals,omitempty"`
+}
+
+// key identifies the request of a recorded operation, for replay
+func (r recordedOperation) key() string {
+	request := recordedOperation{
+		Operation:  r.Operation,
+		BoundDN:    strings.ToLower(r.BoundDN),
+		DN:         strings.ToLower(r.DN),
+		Password:   r.Password,
+		BaseDN:     strings.ToLower(r.BaseDN),
+		Scope:      r.Scope,
+		Filter:     r.Filter,
+		Attributes: r.Attributes,
+		Request:    r.Request,
+	}
+	b, _ := json.Marshal(request)
+	return string(b)
+}
+
+func hashPassword(password string) string {
+	hash := sha256.Sum256([]byte(password))
+	return hex.EncodeToString(hash[:])
+}
+
+func bindRecord(bindDN, bindSimplePw string) recordedOperation {
+	return recordedOperation{Operation: "bind", DN: bindDN, Password: hashPassword(bindSimplePw)}
+}
+
+func searchRecord(boundDN string, searchReq ldap.SearchRequest) recordedOperation {
+	return recordedOperation{Operation: "search", BoundDN: boundDN, BaseDN: searchReq.BaseDN, Scope: searchReq.Scope, Filter: searchReq.Filter, Attributes: searchReq.Attributes}
+}
+
+// recordingHandler appends every operation it forwards, and its response, to a file
+type recordingHandler struct {
+	Handler
+	lock *sync.Mutex
+	file *os.File
+	log  *zap.Logger
+}
+
+// WithRecorder wraps a handler so that every bind, search, add, modify and delete, along
+// with the response, is appended to path as a JSON line, for a replay backend to serve later
+func WithRecorder(h Handler, path string, log *zap.Logger) (Handler, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return recordingHandler{Handler: h, lock: &sync.Mutex{}, file: file, log: log}, nil
+}
+
+func (r recordingHandler) record(op recordedOperation, resultCode ldap.LDAPResultCode, err error) {
+	op.ResultCode = int(resultCode)
+	if err != nil {
+		op.Error = err.Error()
+	}
+	b, merr := json.Marshal(op)
+	if merr != nil {
+		r.log.Error("could not record operation", zap.String("operation", op.Operation), zap.Error(merr))
+		return
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if _, werr := r.file.Write(append(b, '\n')); werr != nil {
+		stats.General.Add("record_errors", 1)
+		r.log.Error("could not record operation", zap.String("operation", op.Operation), zap.Error(werr))
+	}
+}
+
+func (r recordingHandler) Bind(bindDN, bindSimplePw string, conn net.Conn) (ldap.LDAPResultCode, error) {
+	resultCode, err := r.Handler.Bind(bindDN, bindSimplePw, conn)
+	r.record(bindRecord(bindDN, bindSimplePw), resultCode, err)
+	return resultCode, err
+}
+
+func (r recordingHandler) Search(boundDN string, searchReq ldap.SearchRequest, conn net.Conn) (ldap.ServerSearchResult, error) {
+	result, err := r.Handler.Search(boundDN, searchReq, conn)
+	op := searchRecord(boundDN, searchReq)
+	op.Entries = result.Entries
+	op.Referrals = result.Referrals
+	r.record(op, result.ResultCode, err)
+	return result, err
+}
+
+func (r recordingHandler) Add(boundDN string, req ldap.AddRequest, conn net.Conn) (ldap.LDAPResultCode, error) {
+	resultCode, err := r.Handler.Add(boundDN, req, conn)
+	r.record(recordedOperation{Operation: "add", BoundDN: boundDN, Request: fmt.Sprintf("%+v", req)}, resultCode, err)
+	return resultCode, err
+}
+
+func (r recordingHandler) Modify(boundDN string, req ldap.ModifyRequest, conn net.Conn) (ldap.LDAPResultCode, error) {
+	resultCode, err := r.Handler.Modify(boundDN, req, conn)
+	r.record(recordedOperation{Operation: "modify", BoundDN: boundDN, Request: fmt.Sprintf("%+v", req)}, resultCode, err)
+	return resultCode, err
+}
+
+func (r recordingHandler) Delete(boundDN, deleteDN string, conn net.Conn) (ldap.LDAPResultCode, error) {
+	resultCode, err := r.Handler.Delete(boundDN, deleteDN, conn)
+	r.record(recordedOperation{Operation: "delete", BoundDN: boundDN, DN: deleteDN}, resultCode, err)
+	return resultCode, err
+}
+
+// replayHandler answers requests with the responses recorded for identical ones. Requests
+// recorded several times get their responses in the recorded order, the last one repeating.
+type replayHandler struct {
+	lock      *sync.Mutex
+	responses map[string][]recordedOperation
+	log       *zap.Logger
+}
+
+// errNotRecorded answers requests for which the recording holds no response
+var errNotRecorded = errors.New("no recorded response for this request")
+
+// NewReplayHandler creates a handler serving the operations recorded in the backend's ReplayFile
+func NewReplayHandler(opts ...Option) Handler {
+	options := newOptions(opts...)
+
+	handler := replayHandler{
+		lock:      &sync.Mutex{},
+		responses: make(map[string][]recordedOperation),
+		log:       options.Logger,
+	}
+	if err := handler.load(options.Backend.ReplayFile); err != nil {
+		handler.log.Error("could not load recording", zap.String("file", options.Backend.ReplayFile), zap.Error(err))
+		os.Exit(1)
+	}
+	return handler
+}
+
+func (h replayHandler) load(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	line := 0
+	for scanner.Scan() {
+		line++
+		if len(strings.TrimSpace(scanner.Text())) == 0 {
+			continue
+		}
+		var op recordedOperation
+		if err := json.Unmarshal(scanner.Bytes(), &op); err != nil {
+			return fmt.Errorf("line %d: %s", line, err)
+		}
+		key := op.key()
+		h.responses[key] = append(h.responses[key], op)
+	}
+	return scanner.Err()
+}
+
+// replay returns the next response recorded for the request
+func (h replayHandler) replay(op recordedOperation) (recordedOperation, bool) {
+	key := op.key()
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	responses := h.responses[key]
+	if len(responses) == 0 {
+		stats.Frontend.Add("replay_misses", 1)
+		h.log.Info("No recorded response", zap.String("request", key))
+		return recordedOperation{}, false
+	}
+	if len(responses) > 1 {
+		h.responses[key] = responses[1:]
+	}
+	return responses[0], true
+}
+
+func (op recordedOperation) err() error {
+	if op.Error == "" {
+		return nil
+	}
+	return errors.New(op.Error)
+}
+
+func (h replayHandler) Bind(bindDN, bindSimplePw string, conn net.Conn) (ldap.LDAPResultCode, error) {
+	op, ok := h.replay(bindRecord(bindDN, bindSimplePw))
+	if !ok {
+		return ldap.LDAPResultInvalidCredentials, errNotRecorded
+	}
+	return ldap.LDAPResultCode(op.ResultCode), op.err()
+}
+
+func (h replayHandler) Search(boundDN string, searchReq ldap.SearchRequest, conn net.Conn) (ldap.ServerSearchResult, error) {
+	op, ok := h.replay(searchRecord(boundDN, searchReq))
+	if !ok {
+		return ldap.ServerSearchResult{ResultCode: ldap.LDAPResultUnwillingToPerform}, errNotRecorded
+	}
+	return ldap.ServerSearchResult{Entries: op.Entries, Referrals: op.Referrals, ResultCode: ldap.LDAPResultCode(op.ResultCode)}, op.err()
+}
+
+func (h replayHandler) Add(boundDN string, req ldap.AddRequest, conn net.Conn) (ldap.LDAPResultCode, error) {
+	return h.replayWrite(recordedOperation{Operation: "add", BoundDN: boundDN, Request: fmt.Sprintf("%+v", req)})
+}
+
+func (h replayHandler) Modify(boundDN string, req ldap.ModifyRequest, conn net.Conn) (ldap.LDAPResultCode, error) {
+	return h.replayWrite(recordedOperation{Operation: "modify", BoundDN: boundDN, Request: fmt.Sprintf("%+v", req)})
+}
+
+func (h replayHandler) Delete(boundDN, deleteDN string, conn net.Conn) (ldap.LDAPResultCode, error) {
+	return h.replayWrite(recordedOperation{Operation: "delete", BoundDN: boundDN, DN: deleteDN})
+}
+
+func (h replayHandler) replayWrite(request recordedOperation) (ldap.LDAPResultCode, error) {
+	op, ok := h.replay(request)
+	if !ok {
+		return ldap.LDAPResultUnwillingToPerform, errNotRecorded
+	}
+	return ldap.LDAPResultCode(op.ResultCode), op.err()
+}
+
+func (h replayHandler) FindUser(userName string, searchByUPN bool) (bool, config.User, error) {
+	return false, config.User{}, nil
+}
+
+func (h replayHandler) FindGroup(groupName string) (bool, config.Group, error) {
+	return false, config.Group{}, nil
+}
+
+func (h replayHandler) Close(boundDN string, conn net.Conn) error {
+	return nil
+}
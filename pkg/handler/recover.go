@@ -0,0 +1,90 @@
+package handler
+
+import (
+	"fmt"
+	"net"
+	"runtime/debug"
+
+	"github.com/etecs-ru/glauth/v2/pkg/stats"
+	"github.com/nmcclain/ldap"
+	"go.uber.org/zap"
+)
+
+// recoveringHandler keeps a panicking handler from bringing the whole server down
+type recoveringHandler struct {
+	Handler
+	log *zap.Logger
+}
+
+// WithRecovery wraps a handler so that a panic in any operation, e.g. in a plugin, is logged
+// with its stack and answered with an operations error, the other clients being served as usual
+func WithRecovery(h Handler, log *zap.Logger) Handler {
+	return recoveringHandler{Handler: h, log: log}
+}
+
+// report logs a recovered panic and returns the error answered instead. recover itself must
+// be called by the deferred functions: it has no effect anywhere else
+func (r recoveringHandler) report(operation string, p interface{}) error {
+	stats.General.Add("handler_panics", 1)
+	r.log.Error("Handler panic", zap.String("operation", operation), zap.Any("panic", p), zap.ByteString("stack", debug.Stack()))
+	return fmt.Errorf("internal error during %s", operation)
+}
+
+func (r recoveringHandler) Bind(bindDN, bindSimplePw string, conn net.Conn) (resultCode ldap.LDAPResultCode, err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			resultCode = ldap.LDAPResultOperationsError
+			err = r.report("bind", p)
+		}
+	}()
+	return r.Handler.Bind(bindDN, bindSimplePw, conn)
+}
+
+func (r recoveringHandler) Search(boundDN string, searchReq ldap.SearchRequest, conn net.Conn) (result ldap.ServerSearchResult, err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			result = ldap.ServerSearchResult{ResultCode: ldap.LDAPResultOperationsError}
+			err = r.report("search", p)
+		}
+	}()
+	return r.Handler.Search(boundDN, searchReq, conn)
+}
+
+func (r recoveringHandler) Add(boundDN string, req ldap.AddRequest, conn net.Conn) (resultCode ldap.LDAPResultCode, err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			resultCode = ldap.LDAPResultOperationsError
+			err = r.report("add", p)
+		}
+	}()
+	return r.Handler.Add(boundDN, req, conn)
+}
+
+func (r recoveringHandler) Modify(boundDN string, req ldap.ModifyRequest, conn net.Conn) (resultCode ldap.LDAPResultCode, err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			resultCode = ldap.LDAPResultOperationsError
+			err = r.report("modify", p)
+		}
+	}()
+	return r.Handler.Modify(boundDN, req, conn)
+}
+
+func (r recoveringHandler) Delete(boundDN, deleteDN string, conn net.Conn) (resultCode ldap.LDAPResultCode, err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			resultCode = ldap.LDAPResultOperationsError
+			err = r.report("delete", p)
+		}
+	}()
+	return r.Handler.Delete(boundDN, deleteDN, conn)
+}
+
+func (r recoveringHandler) Close(boundDN string, conn net.Conn) (err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			err = r.report("close", p)
+		}
+	}()
+	return r.Handler.Close(boundDN, conn)
+}
@@ -0,0 +1,38 @@
+package handler
+
+import (
+	"fmt"
+
+	"github.com/etecs-ru/glauth/v2/pkg/config"
+	"github.com/etecs-ru/glauth/v2/pkg/stats"
+	"github.com/nmcclain/ldap"
+)
+
+// resultCodeMap translates the result codes of failed upstream operations, by upstream code
+type resultCodeMap map[int]ldap.LDAPResultCode
+
+// newResultCodeMap validates the configured mappings. Nothing may be mapped to or from
+// success: a failed upstream bind must never let a client in
+func newResultCodeMap(mappings []config.ResultCodeMapping) (resultCodeMap, error) {
+	m := make(resultCodeMap, len(mappings))
+	for _, mapping := range mappings {
+		if mapping.From < 1 || mapping.From > 255 || mapping.To < 1 || mapping.To > 255 {
+			return nil, fmt.Errorf("invalid result code mapping %d -> %d, codes must be between 1 and 255", mapping.From, mapping.To)
+		}
+		m[mapping.From] = ldap.LDAPResultCode(mapping.To)
+	}
+	return m, nil
+}
+
+// translate returns the code configured for the upstream error, or fallback
+func (m resultCodeMap) translate(err error, fallback ldap.LDAPResultCode) ldap.LDAPResultCode {
+	e, ok := err.(*ldap.Error)
+	if !ok {
+		return fallback
+	}
+	if code, ok := m[int(e.ResultCode)]; ok {
+		stats.Frontend.Add("result_codes_mapped", 1)
+		return code
+	}
+	return fallback
+}
@@ -0,0 +1,43 @@
+package handler
+
+import (
+	"context"
+	"time"
+
+	"github.com/etecs-ru/glauth/v2/pkg/stats"
+	"github.com/nmcclain/ldap"
+)
+
+// defaultBusyRetryBackoff is the wait before the first retry when none is configured
+const defaultBusyRetryBackoff = 100 * time.Millisecond
+
+// transientResult tells whether the upstream server refused an operation for being busy or
+// unavailable, as opposed to failing it or becoming unreachable
+func transientResult(err error) bool {
+	e, ok := err.(*ldap.Error)
+	return ok && (e.ResultCode == ldap.LDAPResultBusy || e.ResultCode == ldap.LDAPResultUnavailable)
+}
+
+// retryBusy runs op again, on the same upstream connection, for as long as it comes back busy
+// or unavailable and the configured retries last, doubling the wait after each attempt. Only
+// binds and searches are retried: the LDAP backend does not forward writes.
+func (h ldapHandler) retryBusy(ctx context.Context, operation string, op func() error) error {
+	err := op()
+	backoff := time.Duration(h.backend.BusyRetryBackoff) * time.Millisecond
+	if backoff <= 0 {
+		backoff = defaultBusyRetryBackoff
+	}
+	for attempt := 0; attempt < h.backend.BusyRetries && transientResult(err); attempt++ {
+		stats.Frontend.Add(operation+"_busy_retries", 1)
+		timer := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+		backoff *= 2
+		err = op()
+	}
+	return err
+}
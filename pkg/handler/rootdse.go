@@ -0,0 +1,167 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"net"
+
+	"github.com/etecs-ru/glauth/v2/pkg/config"
+	"github.com/etecs-ru/glauth/v2/pkg/stats"
+	"github.com/nmcclain/ldap"
+	"go.uber.org/zap"
+)
+
+// rootDSEAggregate is the RootDSE setting answering root DSE queries with the union of every backend's answer
+const rootDSEAggregate = "aggregate"
+
+// rootDSEListAttributes are the root DSE attributes whose values are merged across backends
+var rootDSEListAttributes = []string{
+	"namingContexts",
+	"supportedCapabilities",
+	"supportedControl",
+	"supportedExtension",
+	"supportedFeatures",
+	"supportedLDAPVersion",
+	"supportedSASLMechanisms",
+}
+
+// rootDSEHandler answers root DSE queries from a chosen backend, or from all of them
+type rootDSEHandler struct {
+	Handler
+	handlers HandlerWrapper
+	target   int  // backend answering root DSE queries, -1 to aggregate every backend
+	routed   bool // the wrapped handler already forwards Close to every backend
+	log      *zap.Logger
+}
+
+// WithRootDSE wraps a handler so that root DSE queries are answered by the backend named
+// by setting, or with the union of every backend's answer when setting is "aggregate".
+// Other operations, and root DSE queries when setting is empty, reach the wrapped handler.
+func WithRootDSE(h Handler, handlers HandlerWrapper, cfg *config.Config, log *zap.Logger) (Handler, error) {
+	setting := cfg.Behaviors.RootDSE
+	if setting == "" {
+		return h, nil
+	}
+	_, routed := h.(routingHandler)
+	r := rootDSEHandler{Handler: h, handlers: handlers, target: -1, routed: routed, log: log}
+	if setting != rootDSEAggregate {
+		for i, b := range cfg.Backends {
+			if i <= *handlers.Count && b.Name == setting {
+				r.target = i
+				break
+			}
+		}
+		if r.target < 0 {
+			return nil, fmt.Errorf("root DSE: no backend named %s", setting)
+		}
+	}
+	return r, nil
+}
+
+// isRootDSEQuery tells whether a search reads the root DSE
+func isRootDSEQuery(searchReq ldap.SearchRequest) bool {
+	return searchReq.BaseDN == "" && searchReq.Scope == ldap.ScopeBaseObject
+}
+
+func (r rootDSEHandler) Bind(bindDN, bindSimplePw string, conn net.Conn) (ldap.LDAPResultCode, error) {
+	return r.BindContext(ConnContext(conn), bindDN, bindSimplePw, conn)
+}
+
+func (r rootDSEHandler) BindContext(ctx context.Context, bindDN, bindSimplePw string, conn net.Conn) (ldap.LDAPResultCode, error) {
+	return searchOrBind{r.Handler}.bind(ctx, bindDN, bindSimplePw, conn)
+}
+
+func (r rootDSEHandler) Search(boundDN string, searchReq ldap.SearchRequest, conn net.Conn) (ldap.ServerSearchResult, error) {
+	return r.SearchContext(ConnContext(conn), boundDN, searchReq, conn)
+}
+
+func (r rootDSEHandler) SearchContext(ctx context.Context, boundDN string, searchReq ldap.SearchRequest, conn net.Conn) (ldap.ServerSearchResult, error) {
+	if !isRootDSEQuery(searchReq) {
+		return searchOrBind{r.Handler}.search(ctx, boundDN, searchReq, conn)
+	}
+	if r.target >= 0 {
+		stats.Frontend.Add("rootdse_searches", 1)
+		return searchOrBind{r.handlers.Handlers[r.target]}.search(ctx, boundDN, searchReq, conn)
+	}
+	stats.Frontend.Add("rootdse_aggregated_searches", 1)
+
+	// The wrapped handler answers first, with the identity presented the way it expects,
+	// and its answer is the base onto which the other backends' values are merged
+	result, err := searchOrBind{r.Handler}.search(ctx, boundDN, searchReq, conn)
+	var root *ldap.Entry
+	if err == nil && len(result.Entries) > 0 {
+		root = result.Entries[0]
+	}
+	for i := 0; i <= *r.handlers.Count; i++ {
+		if i == 0 && !r.routed {
+			continue
+		}
+		other, e := searchOrBind{r.handlers.Handlers[i]}.search(ctx, boundDN, searchReq, conn)
+		if e != nil || len(other.Entries) == 0 {
+			r.log.Debug("Backend left out of the root DSE", zap.Int("backend", i), zap.Error(e))
+			continue
+		}
+		if root == nil {
+			result, err, root = other, nil, other.Entries[0]
+			continue
+		}
+		mergeRootDSE(root, other.Entries[0])
+	}
+	return result, err
+}
+
+// mergeRootDSE adds to root the values of other's list attributes it lacks
+func mergeRootDSE(root, other *ldap.Entry) {
+	for _, name := range rootDSEListAttributes {
+		values := findAttribute(other, name)
+		if values == nil || len(values.Values) == 0 {
+			continue
+		}
+		attribute := findAttribute(root, name)
+		if attribute == nil {
+			attribute = &ldap.EntryAttribute{Name: values.Name}
+			root.Attributes = append(root.Attributes, attribute)
+		}
+		for _, v := range values.Values {
+			if !containsFold(attribute.Values, v) {
+				attribute.Values = append(attribute.Values, v)
+			}
+		}
+	}
+}
+
+// Close also reaches the backends that may have served root DSE queries on this connection
+func (r rootDSEHandler) Close(boundDN string, conn net.Conn) error {
+	err := r.Handler.Close(boundDN, conn)
+	if r.routed {
+		return err
+	}
+	for i := 1; i <= *r.handlers.Count; i++ {
+		if r.target >= 0 && i != r.target {
+			continue
+		}
+		if e := r.handlers.Handlers[i].Close(boundDN, conn); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// searchOrBind calls the context-aware methods of a handler when it has them
+type searchOrBind struct {
+	Handler
+}
+
+func (s searchOrBind) bind(ctx context.Context, bindDN, bindSimplePw string, conn net.Conn) (ldap.LDAPResultCode, error) {
+	if ch, ok := s.Handler.(ContextHandler); ok {
+		return ch.BindContext(ctx, bindDN, bindSimplePw, conn)
+	}
+	return s.Handler.Bind(bindDN, bindSimplePw, conn)
+}
+
+func (s searchOrBind) search(ctx context.Context, boundDN string, searchReq ldap.SearchRequest, conn net.Conn) (ldap.ServerSearchResult, error) {
+	if ch, ok := s.Handler.(ContextHandler); ok {
+		return ch.SearchContext(ctx, boundDN, searchReq, conn)
+	}
+	return s.Handler.Search(boundDN, searchReq, conn)
+}
@@ -0,0 +1,190 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+
+	"github.com/etecs-ru/glauth/v2/pkg/config"
+	"github.com/etecs-ru/glauth/v2/pkg/stats"
+	"github.com/nmcclain/ldap"
+	"go.uber.org/zap"
+)
+
+// route sends identities whose user name matches pattern to a backend
+type route struct {
+	pattern *regexp.Regexp
+	backend int
+}
+
+// routingHandler dispatches every operation to the backend serving the identity involved
+type routingHandler struct {
+	handlers HandlerWrapper
+	routes   []route
+	fallback int
+	cfg      *config.Config
+	log      *zap.Logger
+}
+
+// NewRoutingHandler returns a handler routing binds, and operations of bound identities, to
+// the backend named by the user's AuthBackend, else to the backend claiming the domain of a
+// user@domain name, else to the backend of the first route whose pattern matches the user
+// name, else to the default backend
+func NewRoutingHandler(handlers HandlerWrapper, cfg *config.Config, log *zap.Logger) (Handler, error) {
+	routing := cfg.Routing
+	r := routingHandler{handlers: handlers, fallback: routing.DefaultBackend, cfg: cfg, log: log}
+	if r.fallback < 0 || r.fallback > *handlers.Count {
+		return nil, fmt.Errorf("routing: no backend at position %d", r.fallback)
+	}
+	for _, u := range cfg.Users {
+		if u.AuthBackend != "" && r.namedBackend(u.AuthBackend) < 0 {
+			return nil, fmt.Errorf("routing: no backend named %s for user %s", u.AuthBackend, u.Name)
+		}
+	}
+	for _, rt := range routing.Routes {
+		if rt.Backend < 0 || rt.Backend > *handlers.Count {
+			return nil, fmt.Errorf("routing: no backend at position %d for pattern %s", rt.Backend, rt.Pattern)
+		}
+		pattern, err := regexp.Compile(rt.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("routing: invalid pattern %s: %s", rt.Pattern, err)
+		}
+		r.routes = append(r.routes, route{pattern: pattern, backend: rt.Backend})
+	}
+	return r, nil
+}
+
+// routeDN returns the backend serving the identity named by dn, and the DN to present it with
+func (r routingHandler) routeDN(dn string) (Handler, string) {
+	userName := dn
+	if i := strings.Index(userName, ","); i >= 0 {
+		userName = userName[:i]
+	}
+	if i := strings.Index(userName, "="); i >= 0 {
+		userName = userName[i+1:]
+	}
+	backend := r.fallback
+	if override := r.userBackend(userName); override >= 0 {
+		backend = override
+	} else if upnBackend, upnDN := r.upnBackend(dn); upnBackend >= 0 {
+		backend, dn = upnBackend, upnDN
+	} else if userName != "" {
+		for _, rt := range r.routes {
+			if rt.pattern.MatchString(userName) {
+				backend = rt.backend
+				break
+			}
+		}
+	}
+	stats.Frontend.Add(fmt.Sprintf("routed_to_%d", backend), 1)
+	r.log.Debug("Routing", zap.String("dn", dn), zap.Int("backend", backend))
+	return r.handlers.Handlers[backend], dn
+}
+
+// upnBackend returns the position of the backend serving the domain of a user@domain bind
+// name, and the DN built from the backend's BindDNTemplate; -1 when no backend claims it
+func (r routingHandler) upnBackend(name string) (int, string) {
+	at := strings.LastIndex(name, "@")
+	if at < 1 || strings.ContainsAny(name, "=,") {
+		return -1, name
+	}
+	user, domain := name[:at], name[at+1:]
+	for i, b := range r.cfg.Backends {
+		if i > *r.handlers.Count {
+			break
+		}
+		for _, suffix := range b.UPNSuffixes {
+			if strings.EqualFold(suffix, domain) {
+				if b.BindDNTemplate == "" {
+					return i, name
+				}
+				return i, strings.NewReplacer("{user}", user, "{domain}", domain, "{upn}", name).Replace(b.BindDNTemplate)
+			}
+		}
+	}
+	return -1, name
+}
+
+// userBackend returns the position of the backend set as the user's AuthBackend, or -1
+func (r routingHandler) userBackend(userName string) int {
+	if userName == "" {
+		return -1
+	}
+	for _, u := range r.cfg.Users {
+		if u.AuthBackend != "" && strings.EqualFold(u.Name, userName) {
+			return r.namedBackend(u.AuthBackend)
+		}
+	}
+	return -1
+}
+
+// namedBackend returns the position of the backend called name, or -1
+func (r routingHandler) namedBackend(name string) int {
+	for i, b := range r.cfg.Backends {
+		if i <= *r.handlers.Count && b.Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+func (r routingHandler) Bind(bindDN, bindSimplePw string, conn net.Conn) (ldap.LDAPResultCode, error) {
+	return r.BindContext(ConnContext(conn), bindDN, bindSimplePw, conn)
+}
+
+func (r routingHandler) BindContext(ctx context.Context, bindDN, bindSimplePw string, conn net.Conn) (ldap.LDAPResultCode, error) {
+	h, bindDN := r.routeDN(bindDN)
+	if ch, ok := h.(ContextHandler); ok {
+		return ch.BindContext(ctx, bindDN, bindSimplePw, conn)
+	}
+	return h.Bind(bindDN, bindSimplePw, conn)
+}
+
+// Search is served by the backend of the bound identity, anonymous searches by the default backend
+func (r routingHandler) Search(boundDN string, searchReq ldap.SearchRequest, conn net.Conn) (ldap.ServerSearchResult, error) {
+	return r.SearchContext(ConnContext(conn), boundDN, searchReq, conn)
+}
+
+func (r routingHandler) SearchContext(ctx context.Context, boundDN string, searchReq ldap.SearchRequest, conn net.Conn) (ldap.ServerSearchResult, error) {
+	h, boundDN := r.routeDN(boundDN)
+	if ch, ok := h.(ContextHandler); ok {
+		return ch.SearchContext(ctx, boundDN, searchReq, conn)
+	}
+	return h.Search(boundDN, searchReq, conn)
+}
+
+// Close is forwarded to every backend the connection may have used
+func (r routingHandler) Close(boundDN string, conn net.Conn) error {
+	var err error
+	for i := 0; i <= *r.handlers.Count; i++ {
+		if e := r.handlers.Handlers[i].Close(boundDN, conn); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+func (r routingHandler) Add(boundDN string, req ldap.AddRequest, conn net.Conn) (ldap.LDAPResultCode, error) {
+	h, boundDN := r.routeDN(boundDN)
+	return h.Add(boundDN, req, conn)
+}
+
+func (r routingHandler) Modify(boundDN string, req ldap.ModifyRequest, conn net.Conn) (ldap.LDAPResultCode, error) {
+	h, boundDN := r.routeDN(boundDN)
+	return h.Modify(boundDN, req, conn)
+}
+
+func (r routingHandler) Delete(boundDN, deleteDN string, conn net.Conn) (ldap.LDAPResultCode, error) {
+	h, boundDN := r.routeDN(boundDN)
+	return h.Delete(boundDN, deleteDN, conn)
+}
+
+func (r routingHandler) FindUser(userName string, searchByUPN bool) (bool, config.User, error) {
+	return r.handlers.Handlers[r.fallback].FindUser(userName, searchByUPN)
+}
+
+func (r routingHandler) FindGroup(groupName string) (bool, config.Group, error) {
+	return r.handlers.Handlers[r.fallback].FindGroup(groupName)
+}
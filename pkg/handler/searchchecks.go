@@ -0,0 +1,167 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/nmcclain/ldap"
+)
+
+// searchChecksHandler applies the filter, scope, requested attributes and size limit of
+// searches to the entries backends return, as the LDAP library would, which is told not to:
+// its checks would drop the attributes always returned, and entries whose values a matched
+// values control trimmed after they were found matching the filter
+type searchChecksHandler struct {
+	Handler
+	always []string
+}
+
+// WithSearchChecks wraps a handler so that search results are checked against the request,
+// and the always attributes asked of the backends, and kept in the entries they return, for
+// searches requesting a list of attributes
+func WithSearchChecks(h Handler, always []string) Handler {
+	return searchChecksHandler{Handler: h, always: always}
+}
+
+func (a searchChecksHandler) Bind(bindDN, bindSimplePw string, conn net.Conn) (ldap.LDAPResultCode, error) {
+	return a.BindContext(ConnContext(conn), bindDN, bindSimplePw, conn)
+}
+
+func (a searchChecksHandler) BindContext(ctx context.Context, bindDN, bindSimplePw string, conn net.Conn) (ldap.LDAPResultCode, error) {
+	return searchOrBind{a.Handler}.bind(ctx, bindDN, bindSimplePw, conn)
+}
+
+func (a searchChecksHandler) Search(boundDN string, searchReq ldap.SearchRequest, conn net.Conn) (ldap.ServerSearchResult, error) {
+	return a.SearchContext(ConnContext(conn), boundDN, searchReq, conn)
+}
+
+func (a searchChecksHandler) SearchContext(ctx context.Context, boundDN string, searchReq ldap.SearchRequest, conn net.Conn) (ldap.ServerSearchResult, error) {
+	requested := searchReq.Attributes
+	// "1.1" asks for no attribute at all, which clients expecting some do not send
+	if len(a.always) > 0 && listsAttributes(requested) {
+		searchReq.Attributes = append(append([]string{}, requested...), a.always...)
+		requested = searchReq.Attributes
+	}
+	valuesFilters, err := matchedValuesFilters(searchReq.Controls)
+	if err != nil {
+		return ldap.ServerSearchResult{ResultCode: ldap.LDAPResultProtocolError}, fmt.Errorf("Search Error: %s", err)
+	}
+	result, err := searchOrBind{a.Handler}.search(ctx, boundDN, searchReq, conn)
+	if err != nil {
+		return result, err
+	}
+	// backends honouring a matched values control match the filter before trimming values,
+	// after which the entries may no longer match it. The values of the others are trimmed
+	// here, once the filter is matched.
+	var matched bool
+	result.Controls, matched = takeFilterMatched(result.Controls)
+	result.Entries, result.ResultCode, err = enforceSearch(searchReq, requested, result.Entries, !matched)
+	if err == nil && !matched {
+		trimMatchedValues(result.Entries, valuesFilters)
+	}
+	return result, err
+}
+
+// listsAttributes tells whether a search asks for some attributes only
+func listsAttributes(requested []string) bool {
+	if len(requested) == 0 || (len(requested) == 1 && (requested[0] == "" || requested[0] == "1.1")) {
+		return false
+	}
+	for _, name := range requested {
+		if name == "*" {
+			return false
+		}
+	}
+	return true
+}
+
+// enforceSearch keeps the entries matching the search filter, unless already matched, within
+// its scope, up to its size limit, with the requested attributes only, as the LDAP library
+// does for strict servers
+func enforceSearch(searchReq ldap.SearchRequest, requested []string, entries []*ldap.Entry, match bool) ([]*ldap.Entry, ldap.LDAPResultCode, error) {
+	packet, err := ldap.CompileFilter(searchReq.Filter)
+	if err != nil {
+		return nil, ldap.LDAPResultOperationsError, err
+	}
+	baseDN := strings.ToLower(searchReq.BaseDN)
+	kept := []*ldap.Entry{}
+	for _, entry := range entries {
+		keep := true
+		if match {
+			var code ldap.LDAPResultCode
+			if keep, code = ldap.ServerApplyFilter(packet, filterView(entry)); code != ldap.LDAPResultSuccess {
+				return nil, code, errors.New("ServerApplyFilter error")
+			}
+		}
+		if !keep || !inScope(searchReq.Scope, baseDN, strings.ToLower(entry.DN)) {
+			continue
+		}
+		if searchReq.SizeLimit > 0 && len(kept) >= searchReq.SizeLimit {
+			break
+		}
+		kept = append(kept, &ldap.Entry{DN: entry.DN, Attributes: keptAttributes(entry.Attributes, requested)})
+	}
+	return kept, ldap.LDAPResultSuccess, nil
+}
+
+// filterView returns the entry as filters see it: with its operational attributes under their
+// own names, without the "+" backends prefix them with
+func filterView(entry *ldap.Entry) *ldap.Entry {
+	view := &ldap.Entry{DN: entry.DN, Attributes: make([]*ldap.EntryAttribute, 0, len(entry.Attributes))}
+	renamed := false
+	for _, attribute := range entry.Attributes {
+		if strings.HasPrefix(attribute.Name, "+") {
+			attribute = &ldap.EntryAttribute{Name: attribute.Name[1:], Values: attribute.Values}
+			renamed = true
+		}
+		view.Attributes = append(view.Attributes, attribute)
+	}
+	if !renamed {
+		return entry
+	}
+	return view
+}
+
+// inScope tells whether the lowercased dn falls within the scope of a search of baseDN
+func inScope(scope int, baseDN, dn string) bool {
+	switch scope {
+	case ldap.ScopeBaseObject:
+		return dn == baseDN
+	case ldap.ScopeSingleLevel:
+		parts := strings.Split(dn, ",")
+		return len(parts) >= 2 && strings.Join(parts[1:], ",") == baseDN
+	}
+	return true
+}
+
+// keptAttributes returns the attributes a search asked for, operational ones, whose names
+// backends prefix with "+", only when requested by name or with "+"
+func keptAttributes(attributes []*ldap.EntryAttribute, requested []string) []*ldap.EntryAttribute {
+	kept := []*ldap.EntryAttribute{}
+	all := len(requested) == 0 || (len(requested) == 1 && requested[0] == "")
+	for _, attribute := range attributes {
+		lower := strings.ToLower(attribute.Name)
+		operational := strings.HasPrefix(lower, "+")
+		if all {
+			if !operational {
+				kept = append(kept, attribute)
+			}
+			continue
+		}
+		for _, name := range requested {
+			name = strings.ToLower(name)
+			if operational && (name == "+" || lower == "+"+name) {
+				kept = append(kept, &ldap.EntryAttribute{Name: attribute.Name[1:], Values: attribute.Values})
+				break
+			}
+			if !operational && (name == "*" || lower == name) {
+				kept = append(kept, attribute)
+				break
+			}
+		}
+	}
+	return kept
+}
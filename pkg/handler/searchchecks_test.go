@@ -0,0 +1,99 @@
+package handler
+
+import (
+	"net"
+	"testing"
+
+	"github.com/etecs-ru/glauth/v2/pkg/config"
+	ber "github.com/nmcclain/asn1-ber"
+	"github.com/nmcclain/ldap"
+)
+
+// staticHandler answers every search with the same entries, leaving the filter to the frontend
+type staticHandler struct {
+	Handler
+	entries []*ldap.Entry
+}
+
+func (s staticHandler) Search(boundDN string, searchReq ldap.SearchRequest, conn net.Conn) (ldap.ServerSearchResult, error) {
+	entries := []*ldap.Entry{}
+	for _, e := range s.entries {
+		entries = append(entries, &ldap.Entry{DN: e.DN, Attributes: append([]*ldap.EntryAttribute{}, e.Attributes...)})
+	}
+	return ldap.ServerSearchResult{Entries: entries, ResultCode: ldap.LDAPResultSuccess}, nil
+}
+
+// matchedValuesControl builds a matched values control whose ValuesReturnFilter holds items
+func matchedValuesControl(t *testing.T, items ...string) ldap.Control {
+	t.Helper()
+	packet := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "ValuesReturnFilter")
+	for _, item := range items {
+		f, err := ldap.CompileFilter(item)
+		if err != nil {
+			t.Fatal(err)
+		}
+		packet.AppendChild(f)
+	}
+	return ldap.NewControlString(ControlTypeMatchedValues, false, string(packet.Bytes()))
+}
+
+func TestMatchedValuesStillFiltered(t *testing.T) {
+	entry := func(cn string, mails ...string) *ldap.Entry {
+		return &ldap.Entry{DN: "cn=" + cn + ",dc=example,dc=com", Attributes: []*ldap.EntryAttribute{
+			{Name: "cn", Values: []string{cn}},
+			{Name: "mail", Values: mails},
+		}}
+	}
+	backend := staticHandler{entries: []*ldap.Entry{
+		entry("alice", "alice@example.com", "alice@example.org"),
+		entry("bob", "bob@example.com"),
+	}}
+	conn, peer := net.Pipe()
+	defer conn.Close()
+	defer peer.Close()
+	result, err := WithSearchChecks(backend, nil).Search("", ldap.SearchRequest{
+		BaseDN:   "dc=example,dc=com",
+		Scope:    ldap.ScopeWholeSubtree,
+		Filter:   "(cn=alice)",
+		Controls: []ldap.Control{matchedValuesControl(t, "(mail=alice@example.org)")},
+	}, conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Entries) != 1 || result.Entries[0].DN != "cn=alice,dc=example,dc=com" {
+		t.Fatalf("expected alice alone, got %d entries", len(result.Entries))
+	}
+	if mails := result.Entries[0].GetAttributeValues("mail"); len(mails) != 1 || mails[0] != "alice@example.org" {
+		t.Errorf("expected the matched mail only, got %v", mails)
+	}
+	if len(result.Controls) != 0 {
+		t.Errorf("expected no control in the result, got %v", result.Controls)
+	}
+	// the entries of the backend are left untouched
+	if mails := backend.entries[0].GetAttributeValues("mail"); len(mails) != 2 {
+		t.Errorf("backend entry trimmed: %v", mails)
+	}
+}
+
+func TestMatchedValuesMatchedByBackend(t *testing.T) {
+	h := WithSearchChecks(newTestConfigHandler(config.Backend{}, "alice", "bob"), nil)
+	conn, peer := net.Pipe()
+	defer conn.Close()
+	defer peer.Close()
+	// the filter only matches the values the control drops, the config backend matches it first
+	result, err := h.Search("cn=alice,dc=example,dc=com", ldap.SearchRequest{
+		BaseDN:   "ou=users,dc=example,dc=com",
+		Scope:    ldap.ScopeWholeSubtree,
+		Filter:   "(&(cn=bob)(objectClass=posixAccount))",
+		Controls: []ldap.Control{matchedValuesControl(t, "(objectClass=shadowAccount)")},
+	}, conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Entries) != 1 {
+		t.Fatalf("expected bob alone, got %d entries", len(result.Entries))
+	}
+	if classes := result.Entries[0].GetAttributeValues("objectClass"); len(classes) != 1 || classes[0] != "shadowAccount" {
+		t.Errorf("expected objectClass trimmed to shadowAccount, got %v", classes)
+	}
+}
@@ -0,0 +1,88 @@
+package handler
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/etecs-ru/glauth/v2/pkg/stats"
+	"go.uber.org/zap"
+)
+
+// defaultSRVRefresh is how often SRV records are looked up again when SRVRefresh is not set
+const defaultSRVRefresh = 300 * time.Second
+
+// lookupSRV resolves the SRV records called name into sorted server URLs carrying their
+// priority and weight. The scheme follows the service label: ldaps for _ldaps, ldap otherwise.
+func lookupSRV(name string) ([]string, error) {
+	_, records, err := net.LookupSRV("", "", name)
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		return nil, fmt.Errorf("no SRV records for %s", name)
+	}
+	scheme := "ldap"
+	if strings.HasPrefix(strings.ToLower(name), "_ldaps.") {
+		scheme = "ldaps"
+	}
+	urls := make([]string, 0, len(records))
+	for _, r := range records {
+		// a weight of 0 only means "least preferred" in DNS, server URLs start at 1
+		weight := int(r.Weight)
+		if weight == 0 {
+			weight = 1
+		}
+		urls = append(urls, fmt.Sprintf("%s://%s:%d?priority=%d&weight=%d", scheme, strings.TrimSuffix(r.Target, "."), r.Port, r.Priority, weight))
+	}
+	sort.Strings(urls)
+	return urls, nil
+}
+
+// watchSRV looks the SRV records of the backend up again every refresh period, and replaces
+// the servers when the records changed. Failed lookups keep the current servers.
+func (h ldapHandler) watchSRV(current []string) {
+	refresh := time.Duration(h.backend.SRVRefresh) * time.Second
+	if refresh <= 0 {
+		refresh = defaultSRVRefresh
+	}
+	ticker := time.NewTicker(refresh)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-h.done:
+			return
+		case <-ticker.C:
+		}
+		urls, err := lookupSRV(h.backend.ServersSRV)
+		if err != nil {
+			stats.Backend.Add("srv_lookup_failures", 1)
+			h.log.Warn("SRV lookup failed, keeping the current servers", zap.String("serverssrv", h.backend.ServersSRV), zap.Error(err))
+			continue
+		}
+		if sameStrings(urls, current) {
+			continue
+		}
+		stats.Backend.Add("srv_updates", 1)
+		h.log.Info("SRV records changed", zap.Strings("servers", urls))
+		if err := h.SetServers(urls); err != nil {
+			h.log.Warn("Could not apply the servers of SRV records", zap.String("serverssrv", h.backend.ServersSRV), zap.Error(err))
+			continue
+		}
+		current = urls
+	}
+}
+
+func sameStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,108 @@
+package handler
+
+import (
+	"sync"
+	"time"
+
+	"github.com/etecs-ru/glauth/v2/pkg/stats"
+	"github.com/nmcclain/ldap"
+	"go.uber.org/zap"
+)
+
+// standbyMaxAge is how long an idle standby connection is trusted before being dialed again,
+// as upstream servers and firewalls silently drop idle connections
+const standbyMaxAge = 2 * time.Minute
+
+// standbyConn is an idle connection opened ahead of time, for a session to take over
+type standbyConn struct {
+	server string // url of the server the connection is opened to
+	ldap   *ldap.Conn
+	dialed time.Time
+}
+
+// standbyPool holds the connections kept open to the server that would take over should the
+// preferred one fail, so that failing over does not wait for connections to be dialed
+type standbyPool struct {
+	sync.Mutex
+	conns []standbyConn
+}
+
+// take hands out a fresh standby connection to server, if any
+func (p *standbyPool) take(server string) *ldap.Conn {
+	p.Lock()
+	defer p.Unlock()
+	for i, c := range p.conns {
+		if c.server == server && time.Since(c.dialed) < standbyMaxAge {
+			p.conns = append(p.conns[:i], p.conns[i+1:]...)
+			stats.Backend.Add("standby_taken", 1)
+			return c.ldap
+		}
+	}
+	return nil
+}
+
+// closeAll closes every standby connection
+func (p *standbyPool) closeAll() {
+	p.Lock()
+	conns := p.conns
+	p.conns = nil
+	p.Unlock()
+	for _, c := range conns {
+		c.ldap.Close()
+	}
+}
+
+// refreshStandby keeps the configured number of standby connections open to the server that
+// comes right after the preferred one, dropping those to other servers or grown too old.
+// It runs after every health check, so that standbys follow the servers' health.
+func (h ldapHandler) refreshStandby() {
+	want := h.backend.StandbyConnections
+	if want <= 0 {
+		return
+	}
+	h.lock.Lock()
+	servers := append([]ldapBackend(nil), *h.servers...)
+	h.lock.Unlock()
+	var next ldapBackend
+	found := false
+	if best, ok := h.pickServer(servers); ok {
+		for i := range servers {
+			if servers[i].url() == best.url() {
+				servers[i].Status = Down
+			}
+		}
+		next, found = h.pickServer(servers)
+	}
+
+	var stale []standbyConn
+	h.standby.Lock()
+	kept := h.standby.conns[:0]
+	for _, c := range h.standby.conns {
+		if found && c.server == next.url() && time.Since(c.dialed) < standbyMaxAge {
+			kept = append(kept, c)
+		} else {
+			stale = append(stale, c)
+		}
+	}
+	h.standby.conns = kept
+	missing := want - len(kept)
+	h.standby.Unlock()
+	for _, c := range stale {
+		c.ldap.Close()
+	}
+	if !found {
+		return
+	}
+	for ; missing > 0; missing-- {
+		l, err := h.dial(next)
+		if err != nil {
+			stats.Backend.Add("standby_errors", 1)
+			h.log.Info("could not open standby connection", zap.String("server", next.url()), zap.Error(err))
+			return
+		}
+		h.standby.Lock()
+		h.standby.conns = append(h.standby.conns, standbyConn{server: next.url(), ldap: l, dialed: time.Now()})
+		h.standby.Unlock()
+		stats.Backend.Add("standby_opened", 1)
+	}
+}
@@ -0,0 +1,113 @@
+package handler
+
+import (
+	"fmt"
+	"hash/fnv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/etecs-ru/glauth/v2/pkg/stats"
+	"go.uber.org/zap"
+)
+
+// defaultStickyUsersTTL is how long the last server of a user is remembered by default
+const defaultStickyUsersTTL = 5 * time.Minute
+
+// stickyServers remembers the server on which each bound user last opened a session
+type stickyServers struct {
+	sync.Mutex
+	last map[string]stickyServer // by lowercased DN
+}
+
+type stickyServer struct {
+	url     string
+	expires time.Time
+}
+
+func newStickyServers() *stickyServers {
+	return &stickyServers{last: make(map[string]stickyServer)}
+}
+
+// serverFor picks the server of a new session of userDN: the same one for every session of
+// the user while it is usable, the best server otherwise
+func (h ldapHandler) serverFor(userDN string) (ldapBackend, error) {
+	if h.backend.StickyUsers == "" || userDN == "" {
+		return h.getBestServer()
+	}
+	userDN = strings.ToLower(userDN)
+	h.lock.Lock()
+	servers := append([]ldapBackend(nil), *h.servers...)
+	h.lock.Unlock()
+
+	var sticky ldapBackend
+	found := false
+	switch h.backend.StickyUsers {
+	case "hash":
+		// servers keep their configured order, so that every user maps to the same one as
+		// long as the usable servers of the preferred priority stay the same
+		priority, candidates := h.bestPriority(servers), []ldapBackend{}
+		for _, s := range servers {
+			if h.usable(s) && s.Priority == priority {
+				candidates = append(candidates, s)
+			}
+		}
+		if len(candidates) > 0 {
+			hash := fnv.New32a()
+			hash.Write([]byte(userDN))
+			sticky, found = candidates[hash.Sum32()%uint32(len(candidates))], true
+		}
+	case "last":
+		h.sticky.Lock()
+		last, ok := h.sticky.last[userDN]
+		h.sticky.Unlock()
+		if ok && time.Now().Before(last.expires) {
+			for _, s := range servers {
+				if s.url() == last.url && h.usable(s) {
+					sticky, found = s, true
+					break
+				}
+			}
+		}
+	}
+	if !found {
+		stats.Backend.Add("sticky_misses", 1)
+		best, err := h.getBestServer()
+		if err != nil {
+			return best, err
+		}
+		sticky = best
+	} else {
+		stats.Backend.Add("sticky_hits", 1)
+		h.log.Debug("Sticky server", zap.String("binddn", userDN), zap.String("server", sticky.url()))
+	}
+	if h.backend.StickyUsers == "last" {
+		ttl := time.Duration(h.backend.StickyUsersTTL) * time.Second
+		if ttl <= 0 {
+			ttl = defaultStickyUsersTTL
+		}
+		h.sticky.remember(userDN, sticky.url(), ttl)
+	}
+	return sticky, nil
+}
+
+// remember records the server of a user's latest session, and forgets the expired ones
+func (c *stickyServers) remember(userDN, url string, ttl time.Duration) {
+	now := time.Now()
+	c.Lock()
+	defer c.Unlock()
+	for dn, last := range c.last {
+		if now.After(last.expires) {
+			delete(c.last, dn)
+		}
+	}
+	c.last[userDN] = stickyServer{url: url, expires: now.Add(ttl)}
+}
+
+func validateStickyUsers(strategy string) error {
+	switch strategy {
+	case "", "hash", "last":
+		return nil
+	}
+	return fmt.Errorf("Unknown sticky users strategy: %s - must be one of 'hash', 'last'", strategy)
+}
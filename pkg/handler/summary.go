@@ -0,0 +1,131 @@
+package handler
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/nmcclain/ldap"
+	"go.uber.org/zap"
+)
+
+// connSummary accumulates what happened on one client connection
+type connSummary struct {
+	start    time.Time
+	binds    int
+	searches int
+	writes   int
+	errors   int
+	entries  int
+	bytes    int // decoded request size
+}
+
+// summaryHandler logs one line per client connection, on close, summing up its requests
+type summaryHandler struct {
+	Handler
+	log       *zap.Logger
+	lock      *sync.Mutex // for summaries
+	summaries map[net.Conn]*connSummary
+}
+
+// WithConnectionSummary wraps a handler so that a summary of every connection's binds,
+// searches, writes, errors and request bytes is logged once the connection closes
+func WithConnectionSummary(h Handler, log *zap.Logger) Handler {
+	return summaryHandler{Handler: h, log: log, lock: &sync.Mutex{}, summaries: make(map[net.Conn]*connSummary)}
+}
+
+// record applies update to the summary of conn, creating it on the connection's first request
+func (s summaryHandler) record(conn net.Conn, update func(*connSummary)) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	cs, ok := s.summaries[conn]
+	if !ok {
+		cs = &connSummary{start: time.Now()}
+		s.summaries[conn] = cs
+	}
+	update(cs)
+}
+
+func (s summaryHandler) Bind(bindDN, bindSimplePw string, conn net.Conn) (ldap.LDAPResultCode, error) {
+	resultCode, err := s.Handler.Bind(bindDN, bindSimplePw, conn)
+	s.record(conn, func(cs *connSummary) {
+		cs.binds++
+		cs.bytes += len(bindDN) + len(bindSimplePw)
+		if err != nil || resultCode != ldap.LDAPResultSuccess {
+			cs.errors++
+		}
+	})
+	return resultCode, err
+}
+
+func (s summaryHandler) Search(boundDN string, searchReq ldap.SearchRequest, conn net.Conn) (ldap.ServerSearchResult, error) {
+	result, err := s.Handler.Search(boundDN, searchReq, conn)
+	s.record(conn, func(cs *connSummary) {
+		cs.searches++
+		cs.bytes += searchRequestSize(searchReq)
+		cs.entries += len(result.Entries)
+		if err != nil || result.ResultCode != ldap.LDAPResultSuccess {
+			cs.errors++
+		}
+	})
+	return result, err
+}
+
+func (s summaryHandler) Add(boundDN string, req ldap.AddRequest, conn net.Conn) (ldap.LDAPResultCode, error) {
+	resultCode, err := s.Handler.Add(boundDN, req, conn)
+	s.recordWrite(conn, resultCode, err)
+	return resultCode, err
+}
+
+func (s summaryHandler) Modify(boundDN string, req ldap.ModifyRequest, conn net.Conn) (ldap.LDAPResultCode, error) {
+	resultCode, err := s.Handler.Modify(boundDN, req, conn)
+	s.recordWrite(conn, resultCode, err)
+	return resultCode, err
+}
+
+func (s summaryHandler) Delete(boundDN, deleteDN string, conn net.Conn) (ldap.LDAPResultCode, error) {
+	resultCode, err := s.Handler.Delete(boundDN, deleteDN, conn)
+	s.recordWrite(conn, resultCode, err)
+	return resultCode, err
+}
+
+func (s summaryHandler) recordWrite(conn net.Conn, resultCode ldap.LDAPResultCode, err error) {
+	s.record(conn, func(cs *connSummary) {
+		cs.writes++
+		if err != nil || resultCode != ldap.LDAPResultSuccess {
+			cs.errors++
+		}
+	})
+}
+
+func (s summaryHandler) Close(boundDN string, conn net.Conn) error {
+	s.lock.Lock()
+	cs, ok := s.summaries[conn]
+	delete(s.summaries, conn)
+	s.lock.Unlock()
+	if ok {
+		s.log.Info("Connection summary",
+			zap.String("connid", connID(conn)),
+			zap.String("src", conn.RemoteAddr().String()),
+			zap.String("binddn", boundDN),
+			zap.Int("binds", cs.binds),
+			zap.Int("searches", cs.searches),
+			zap.Int("writes", cs.writes),
+			zap.Int("errors", cs.errors),
+			zap.Int("entries", cs.entries),
+			zap.Int("requestbytes", cs.bytes),
+			zap.Duration("duration", time.Since(cs.start)))
+	}
+	return s.Handler.Close(boundDN, conn)
+}
+
+func searchRequestSize(searchReq ldap.SearchRequest) int {
+	size := len(searchReq.BaseDN) + len(searchReq.Filter)
+	for _, a := range searchReq.Attributes {
+		size += len(a)
+	}
+	for _, c := range searchReq.Controls {
+		size += len(c.String())
+	}
+	return size
+}
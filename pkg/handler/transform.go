@@ -0,0 +1,130 @@
+package handler
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/etecs-ru/glauth/v2/pkg/config"
+	"github.com/nmcclain/ldap"
+)
+
+// templateReference matches the {attribute} placeholders of an attribute transform template
+var templateReference = regexp.MustCompile(`\{([A-Za-z0-9;-]+)\}`)
+
+// applyFixedAttributes adds the configured values to every entry of the backend's tree,
+// leaving alone the root DSE, the schema and anything else outside of baseDN
+func applyFixedAttributes(fixed []config.FixedAttribute, baseDN string, entries []*ldap.Entry) {
+	if len(fixed) == 0 {
+		return
+	}
+	baseDN = strings.ToLower(baseDN)
+	for _, entry := range entries {
+		dn := strings.ToLower(entry.DN)
+		if dn != baseDN && !strings.HasSuffix(dn, ","+baseDN) {
+			continue
+		}
+		for _, f := range fixed {
+			attr := findAttribute(entry, f.Name)
+			if attr == nil {
+				attr = &ldap.EntryAttribute{Name: f.Name}
+				entry.Attributes = append(entry.Attributes, attr)
+			}
+			for _, value := range f.Values {
+				if !containsFold(attr.Values, value) {
+					attr.Values = append(attr.Values, value)
+				}
+			}
+		}
+	}
+}
+
+// containsFold tells whether values holds value, ignoring case
+func containsFold(values []string, value string) bool {
+	for _, v := range values {
+		if strings.EqualFold(v, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// applyAttributeTransforms rewrites attribute values in place, as configured for the backend.
+// Templates are plain substitutions: they only ever read the entry they are applied to
+func applyAttributeTransforms(transforms []config.AttributeTransform, entries []*ldap.Entry) {
+	if len(transforms) == 0 {
+		return
+	}
+	for _, entry := range entries {
+		for _, t := range transforms {
+			if isBinaryAttribute(t.Attribute) {
+				continue
+			}
+			attr := findAttribute(entry, t.Attribute)
+			if attr == nil {
+				if t.Template == "" {
+					continue
+				}
+				value, ok := expandAttributeTemplate(t.Template, entry, "")
+				if !ok {
+					continue
+				}
+				attr = &ldap.EntryAttribute{Name: t.Attribute}
+				attr.Values = []string{transformCase(t.Case, value)}
+				entry.Attributes = append(entry.Attributes, attr)
+				continue
+			}
+			values := make([]string, 0, len(attr.Values))
+			for _, v := range attr.Values {
+				if t.Template != "" {
+					expanded, ok := expandAttributeTemplate(t.Template, entry, v)
+					if !ok {
+						values = append(values, v)
+						continue
+					}
+					v = expanded
+				}
+				values = append(values, transformCase(t.Case, v))
+			}
+			attr.Values = values
+		}
+	}
+}
+
+// expandAttributeTemplate substitutes {value} and {attribute} references, failing
+// when a referenced attribute is missing from the entry
+func expandAttributeTemplate(template string, entry *ldap.Entry, value string) (string, bool) {
+	ok := true
+	expanded := templateReference.ReplaceAllStringFunc(template, func(ref string) string {
+		name := ref[1 : len(ref)-1]
+		if strings.EqualFold(name, "value") {
+			return value
+		}
+		attr := findAttribute(entry, name)
+		if attr == nil || len(attr.Values) == 0 {
+			ok = false
+			return ""
+		}
+		return attr.Values[0]
+	})
+	return expanded, ok
+}
+
+// findAttribute returns the entry's attribute by case-insensitive name, or nil
+func findAttribute(entry *ldap.Entry, name string) *ldap.EntryAttribute {
+	for _, attr := range entry.Attributes {
+		if strings.EqualFold(attr.Name, name) {
+			return attr
+		}
+	}
+	return nil
+}
+
+func transformCase(c, value string) string {
+	switch strings.ToLower(c) {
+	case "lower":
+		return strings.ToLower(value)
+	case "upper":
+		return strings.ToUpper(value)
+	}
+	return value
+}
@@ -0,0 +1,240 @@
+package server
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/etecs-ru/glauth/v2/pkg/handler"
+	"go.uber.org/zap"
+)
+
+// AdminHandler returns the HTTP handler for the admin API. When a secret token is
+// configured, requests must present it as a bearer token. Without one, only the read-only
+// endpoints are served: changing servers or caches, and exporting entries, need a token.
+func (s *LdapSvc) AdminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/config", s.adminConfig)
+	mux.HandleFunc("/health", s.adminHealth)
+	mux.HandleFunc("/health/recheck", s.adminHealthRecheck)
+	if s.c.API.SecretToken == "" {
+		s.log.Warn("No API secret token set, the /servers, /servers/drain, /cache and /ldif endpoints are disabled")
+		return mux
+	}
+	mux.HandleFunc("/servers", s.adminServers)
+	mux.HandleFunc("/servers/drain", s.adminDrain)
+	mux.HandleFunc("/cache", s.adminCache)
+	mux.HandleFunc("/ldif", s.adminLDIF)
+	return s.adminAuth(mux)
+}
+
+func (s *LdapSvc) adminAuth(next http.Handler) http.Handler {
+	expected := []byte("Bearer " + s.c.API.SecretToken)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), expected) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// adminConfig serves the effective configuration, with secrets redacted
+func (s *LdapSvc) adminConfig(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(s.c.Redacted()); err != nil {
+		s.log.Info("Unable to encode config", zap.Error(err))
+	}
+}
+
+// backendHealth is the health of the servers of one backend
+type backendHealth struct {
+	Position int
+	Servers  []handler.ServerStatus
+	Error    string `json:",omitempty"`
+}
+
+// adminHealth serves the outcome of the latest health check of every backend
+func (s *LdapSvc) adminHealth(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	s.writeHealth(w, func(hc handler.HealthChecker) ([]handler.ServerStatus, error) {
+		return hc.ServerStatus(), nil
+	})
+}
+
+// adminHealthRecheck pings every backend's servers right away and serves the outcome
+func (s *LdapSvc) adminHealthRecheck(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	s.writeHealth(w, handler.HealthChecker.CheckHealth)
+}
+
+func (s *LdapSvc) writeHealth(w http.ResponseWriter, check func(handler.HealthChecker) ([]handler.ServerStatus, error)) {
+	health := []backendHealth{}
+	for i := 0; i <= *s.handlers.Count; i++ {
+		hc, ok := s.handlers.Handlers[i].(handler.HealthChecker)
+		if !ok {
+			continue
+		}
+		servers, err := check(hc)
+		bh := backendHealth{Position: i, Servers: servers}
+		if err != nil {
+			bh.Error = err.Error()
+		}
+		health = append(health, bh)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(health); err != nil {
+		s.log.Info("Unable to encode health", zap.Error(err))
+	}
+}
+
+// adminServers replaces the upstream servers of the backend at position ?backend=
+// (default 0) with the JSON array of LDAP URLs in the request body
+func (s *LdapSvc) adminServers(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	position, ok := s.backendPosition(w, r)
+	if !ok {
+		return
+	}
+	su, ok := s.handlers.Handlers[position].(handler.ServerUpdater)
+	if !ok {
+		http.Error(w, "backend has no upstream servers", http.StatusBadRequest)
+		return
+	}
+	var servers []string
+	if err := json.NewDecoder(r.Body).Decode(&servers); err != nil {
+		http.Error(w, "invalid server list: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := su.SetServers(servers); err != nil {
+		s.log.Info("Unable to update servers", zap.Int("backend", position), zap.Error(err))
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	s.writeHealth(w, func(hc handler.HealthChecker) ([]handler.ServerStatus, error) {
+		return hc.ServerStatus(), nil
+	})
+}
+
+// adminDrain takes the upstream server ?url= of the backend at position ?backend= (default 0)
+// out of use, closing its sessions once idle, on POST, and puts it back on DELETE
+func (s *LdapSvc) adminDrain(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost && r.Method != http.MethodDelete {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	position, ok := s.backendPosition(w, r)
+	if !ok {
+		return
+	}
+	sd, ok := s.handlers.Handlers[position].(handler.ServerDrainer)
+	if !ok {
+		http.Error(w, "backend has no upstream servers", http.StatusBadRequest)
+		return
+	}
+	url := r.URL.Query().Get("url")
+	if err := sd.DrainServer(url, r.Method == http.MethodPost); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	s.writeHealth(w, func(hc handler.HealthChecker) ([]handler.ServerStatus, error) {
+		return hc.ServerStatus(), nil
+	})
+}
+
+// cacheEviction is the number of cache entries one backend dropped
+type cacheEviction struct {
+	Position int
+	Evicted  int
+}
+
+// adminCache drops, on DELETE, what the backends have cached about the user ?user=, or the
+// entries under ?dn=, or everything when neither is given; only the backend at ?backend=
+// when given
+func (s *LdapSvc) adminCache(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	user, dn := r.URL.Query().Get("user"), r.URL.Query().Get("dn")
+	if user != "" && dn != "" {
+		http.Error(w, "user and dn are exclusive", http.StatusBadRequest)
+		return
+	}
+	first, last := 0, *s.handlers.Count
+	if r.URL.Query().Get("backend") != "" {
+		position, ok := s.backendPosition(w, r)
+		if !ok {
+			return
+		}
+		first, last = position, position
+	}
+	evictions := []cacheEviction{}
+	for i := first; i <= last; i++ {
+		ce, ok := s.handlers.Handlers[i].(handler.CacheEvicter)
+		if !ok {
+			continue
+		}
+		evictions = append(evictions, cacheEviction{Position: i, Evicted: ce.EvictCache(user, dn)})
+	}
+	s.log.Info("Cache evicted", zap.String("user", user), zap.String("dn", dn), zap.Any("evictions", evictions))
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(evictions); err != nil {
+		s.log.Info("Unable to encode evictions", zap.Error(err))
+	}
+}
+
+// adminLDIF serves the entries of the config backend at position ?backend= (default 0) as
+// LDIF, without password hashes
+func (s *LdapSvc) adminLDIF(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	position, ok := s.backendPosition(w, r)
+	if !ok {
+		return
+	}
+	if _, ok := s.handlers.Handlers[position].(handler.LDAPOpsHandler); !ok {
+		http.Error(w, "backend holds no entries of its own", http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if err := handler.ExportLDIF(w, s.handlers.Handlers[position], false); err != nil {
+		s.log.Info("Unable to export LDIF", zap.Int("backend", position), zap.Error(err))
+	}
+}
+
+// backendPosition reads the backend position of ?backend=, 0 when absent, answering the
+// request with an error when there is no such backend
+func (s *LdapSvc) backendPosition(w http.ResponseWriter, r *http.Request) (int, bool) {
+	position := 0
+	if b := r.URL.Query().Get("backend"); b != "" {
+		var err error
+		if position, err = strconv.Atoi(b); err != nil {
+			http.Error(w, "invalid backend position", http.StatusBadRequest)
+			return 0, false
+		}
+	}
+	if position < 0 || position > *s.handlers.Count {
+		http.Error(w, "no such backend", http.StatusNotFound)
+		return 0, false
+	}
+	return position, true
+}
@@ -0,0 +1,153 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/etecs-ru/glauth/v2/pkg/config"
+	"github.com/nmcclain/ldap"
+)
+
+// ErrInvalidCredentials is returned by Authenticate and Lookup when the bind is refused
+var ErrInvalidCredentials = errors.New("invalid credentials")
+
+// Authenticate binds as username through the same handler chain as LDAP clients, without
+// going through the network. username is either a bind DN or a user name, which is then
+// turned into a DN under the first backend's BaseDN. The user is returned as known to the
+// backends; backends that do not expose users only return its name.
+func (s *LdapSvc) Authenticate(ctx context.Context, username, password string) (*config.User, error) {
+	conn, err := s.localBind(ctx, username, password)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.release()
+
+	name := username
+	if strings.Contains(name, "=") {
+		name = strings.TrimPrefix(strings.SplitN(name, ",", 2)[0], s.nameFormat()+"=")
+	}
+	found, user, err := s.frontend.FindUser(name, false)
+	if err != nil || !found {
+		return &config.User{Name: name}, nil
+	}
+	return &user, nil
+}
+
+// Lookup binds as username, like Authenticate, then searches the first backend's BaseDN
+// subtree for entries matching filter, through the same handler chain as LDAP clients
+func (s *LdapSvc) Lookup(ctx context.Context, username, password, filter string) ([]*ldap.Entry, error) {
+	packet, err := ldap.CompileFilter(filter)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := s.localBind(ctx, username, password)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.release()
+
+	baseDN := s.c.Backends[0].BaseDN
+	result, err := s.frontend.Search(conn.bindDN, ldap.SearchRequest{
+		BaseDN: baseDN,
+		Scope:  ldap.ScopeWholeSubtree,
+		Filter: filter,
+	}, conn)
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	if err != nil {
+		return nil, err
+	}
+	if result.ResultCode != ldap.LDAPResultSuccess {
+		return nil, fmt.Errorf("search failed: %s", ldap.LDAPResultCodeMap[result.ResultCode])
+	}
+	// the LDAP server library filters what handlers return, do the same
+	entries := []*ldap.Entry{}
+	for _, entry := range result.Entries {
+		if !strings.HasSuffix(strings.ToLower(entry.DN), strings.ToLower(baseDN)) {
+			continue
+		}
+		if ok, _ := ldap.ServerApplyFilter(packet, entry); ok {
+			entries = append(entries, entry)
+		}
+	}
+	return entries, nil
+}
+
+// localConn is an in-process client connection, closed through the handler chain once
+// done with or when its context is cancelled, which aborts the backend work in flight
+type localConn struct {
+	net.Conn
+	addr    localAddr
+	bindDN  string
+	once    sync.Once
+	release func()
+	stop    chan struct{}
+}
+
+// localAddr names in-process connections, uniquely so that they never share a backend session
+type localAddr string
+
+func (a localAddr) Network() string { return "local" }
+func (a localAddr) String() string  { return string(a) }
+
+func (c *localConn) RemoteAddr() net.Addr { return c.addr }
+func (c *localConn) LocalAddr() net.Addr  { return localAddr("glauth") }
+
+var localConns uint64
+
+func (s *LdapSvc) localBind(ctx context.Context, username, password string) (*localConn, error) {
+	if s.frontend == nil {
+		return nil, errors.New("no backend configured")
+	}
+	client, server := net.Pipe()
+	client.Close()
+	conn := &localConn{
+		Conn: server,
+		addr: localAddr(fmt.Sprintf("local-%d", atomic.AddUint64(&localConns, 1))),
+		stop: make(chan struct{}),
+	}
+	conn.bindDN = username
+	if !strings.Contains(username, "=") {
+		conn.bindDN = fmt.Sprintf("%s=%s,%s", s.nameFormat(), username, s.c.Backends[0].BaseDN)
+	}
+	conn.release = func() {
+		conn.once.Do(func() {
+			close(conn.stop)
+			s.frontend.Close(conn.bindDN, conn)
+		})
+	}
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.release()
+		case <-conn.stop:
+		}
+	}()
+
+	resultCode, err := s.frontend.Bind(conn.bindDN, password, conn)
+	if ctx.Err() != nil {
+		conn.release()
+		return nil, ctx.Err()
+	}
+	if resultCode != ldap.LDAPResultSuccess {
+		conn.release()
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", ErrInvalidCredentials, err)
+		}
+		return nil, ErrInvalidCredentials
+	}
+	return conn, nil
+}
+
+func (s *LdapSvc) nameFormat() string {
+	if f := s.c.Backends[0].NameFormat; f != "" {
+		return f
+	}
+	return "cn"
+}
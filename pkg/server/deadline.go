@@ -0,0 +1,61 @@
+package server
+
+import (
+	"crypto/tls"
+	"net"
+	"time"
+
+	"github.com/etecs-ru/glauth/v2/pkg/stats"
+)
+
+// deadlineListener hands out connections that are dropped when the client stays silent, or
+// stops reading, for longer than the configured timeouts
+type deadlineListener struct {
+	net.Listener
+	read, write time.Duration
+}
+
+func (l deadlineListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &deadlineConn{Conn: conn, read: l.read, write: l.write}, nil
+}
+
+// deadlineConn pushes its deadlines back before every read and write, so that they bound
+// each wait for the client rather than the whole connection
+type deadlineConn struct {
+	net.Conn
+	read, write time.Duration
+}
+
+func (c *deadlineConn) Read(p []byte) (int, error) {
+	if c.read > 0 {
+		c.Conn.SetReadDeadline(time.Now().Add(c.read))
+	}
+	n, err := c.Conn.Read(p)
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		stats.Frontend.Add("client_read_timeouts", 1)
+	}
+	return n, err
+}
+
+func (c *deadlineConn) Write(p []byte) (int, error) {
+	if c.write > 0 {
+		c.Conn.SetWriteDeadline(time.Now().Add(c.write))
+	}
+	n, err := c.Conn.Write(p)
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		stats.Frontend.Add("client_write_timeouts", 1)
+	}
+	return n, err
+}
+
+// ConnectionState exposes the TLS state of the wrapped connection, for client certificate logging
+func (c *deadlineConn) ConnectionState() tls.ConnectionState {
+	if tlsConn, ok := c.Conn.(interface{ ConnectionState() tls.ConnectionState }); ok {
+		return tlsConn.ConnectionState()
+	}
+	return tls.ConnectionState{}
+}
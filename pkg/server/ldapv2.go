@@ -0,0 +1,120 @@
+package server
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+
+	"github.com/etecs-ru/glauth/v2/pkg/stats"
+)
+
+// maxLDAPv2Message bounds the messages buffered by the LDAPv2 shim, larger ones are passed through
+const maxLDAPv2Message = 1 << 24
+
+// ldapv2Listener hands out connections on which LDAPv2 bind requests are presented as LDAPv3 ones.
+// The LDAP server library rejects any bind whose version is not 3, before handlers get to see it.
+type ldapv2Listener struct {
+	net.Listener
+}
+
+func (l ldapv2Listener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &ldapv2Conn{Conn: conn}, nil
+}
+
+// ldapv2Conn reads the client's stream one LDAPMessage at a time and rewrites the
+// version of bind requests in place; everything else is returned byte for byte
+type ldapv2Conn struct {
+	net.Conn
+	pending     []byte
+	passthrough bool // set after a message could not be framed, the rest of the stream is left alone
+}
+
+func (c *ldapv2Conn) Read(p []byte) (int, error) {
+	if len(c.pending) == 0 {
+		if c.passthrough {
+			return c.Conn.Read(p)
+		}
+		msg, err := c.readMessage()
+		if len(msg) == 0 {
+			return 0, err
+		}
+		c.pending = msg
+	}
+	n := copy(p, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+// ConnectionState exposes the TLS state of the wrapped connection, for client certificate logging
+func (c *ldapv2Conn) ConnectionState() tls.ConnectionState {
+	if tlsConn, ok := c.Conn.(interface{ ConnectionState() tls.ConnectionState }); ok {
+		return tlsConn.ConnectionState()
+	}
+	return tls.ConnectionState{}
+}
+
+// readMessage reads one complete LDAPMessage, rewriting it when it is an LDAPv2 bind request
+func (c *ldapv2Conn) readMessage() ([]byte, error) {
+	header := make([]byte, 2, 6)
+	if _, err := io.ReadFull(c.Conn, header); err != nil {
+		return header, err
+	}
+	length := int(header[1])
+	if header[1]&0x80 != 0 {
+		size := int(header[1] & 0x7f)
+		if size == 0 || size > 3 {
+			c.passthrough = true
+			return header, nil
+		}
+		header = header[:2+size]
+		if _, err := io.ReadFull(c.Conn, header[2:]); err != nil {
+			c.passthrough = true
+			return header, nil
+		}
+		length = 0
+		for _, b := range header[2:] {
+			length = length<<8 | int(b)
+		}
+	}
+	if header[0] != 0x30 || length > maxLDAPv2Message {
+		c.passthrough = true
+		return header, nil
+	}
+	msg := make([]byte, len(header)+length)
+	copy(msg, header)
+	if n, err := io.ReadFull(c.Conn, msg[len(header):]); err != nil {
+		return msg[:len(header)+n], err
+	}
+	rewriteLDAPv2Bind(msg[len(header):])
+	return msg, nil
+}
+
+// rewriteLDAPv2Bind turns the version of a bind request from 2 into 3. content holds
+// the messageID followed by the protocol operation; the version is its first element.
+func rewriteLDAPv2Bind(content []byte) {
+	// messageID: INTEGER, short form length
+	if len(content) < 2 || content[0] != 0x02 || content[1]&0x80 != 0 || len(content) < 2+int(content[1]) {
+		return
+	}
+	op := content[2+int(content[1]):]
+	// BindRequest: [APPLICATION 0] constructed
+	if len(op) < 2 || op[0] != 0x60 {
+		return
+	}
+	skip := 2
+	if op[1]&0x80 != 0 {
+		skip += int(op[1] & 0x7f)
+	}
+	if len(op) < skip+3 {
+		return
+	}
+	version := op[skip:]
+	if version[0] == 0x02 && version[1] == 0x01 && version[2] == 0x02 {
+		version[2] = 0x03
+		stats.Frontend.Add("ldapv2_binds", 1)
+	}
+}
@@ -0,0 +1,16 @@
+package server
+
+import (
+	"context"
+	"net"
+)
+
+// listen opens a TCP listener on address. The accept backlog is the one the operating
+// system grants Go listeners, e.g. net.core.somaxconn on Linux, which is where it is tuned.
+func listen(address string, reusePort bool) (net.Listener, error) {
+	lc := net.ListenConfig{}
+	if reusePort {
+		lc.Control = reusePortControl
+	}
+	return lc.Listen(context.Background(), "tcp", address)
+}
@@ -0,0 +1,43 @@
+package server
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/etecs-ru/glauth/v2/pkg/handler"
+)
+
+// BackendConstructor builds a handler from the options a backend is configured with,
+// like the NewPluginHandler function of a backend plugin
+type BackendConstructor func(...handler.Option) handler.Handler
+
+var (
+	registryLock sync.RWMutex
+	registry     = make(map[string]BackendConstructor)
+)
+
+// builtinDatastores are the datastore names NewServer handles itself
+var builtinDatastores = map[string]bool{"config": true, "ldap": true, "memory": true, "owncloud": true, "plugin": true, "replay": true}
+
+// RegisterBackend makes a datastore available under name, for backends and helpers alike,
+// to programs compiling GLAuth in rather than loading plugins. It is meant to be called
+// from an init function, and panics when name is taken or constructor is nil.
+func RegisterBackend(name string, constructor BackendConstructor) {
+	registryLock.Lock()
+	defer registryLock.Unlock()
+	if constructor == nil {
+		panic("server: RegisterBackend constructor is nil")
+	}
+	if _, dup := registry[name]; dup || builtinDatastores[name] {
+		panic(fmt.Sprintf("server: RegisterBackend called twice for datastore %s", name))
+	}
+	registry[name] = constructor
+}
+
+// registeredBackend returns the constructor registered for a datastore, if any
+func registeredBackend(name string) (BackendConstructor, bool) {
+	registryLock.RLock()
+	defer registryLock.RUnlock()
+	constructor, ok := registry[name]
+	return constructor, ok
+}
@@ -0,0 +1,129 @@
+package server
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+
+	"github.com/etecs-ru/glauth/v2/pkg/stats"
+	ber "github.com/nmcclain/asn1-ber"
+	"github.com/nmcclain/ldap"
+	"go.uber.org/zap"
+)
+
+// noticeOfDisconnection is the responseName of the unsolicited notification of RFC 4511 4.4.1
+const noticeOfDisconnection = "1.3.6.1.4.1.1466.20036"
+
+// errRequestTooLarge ends the connection of a client whose request exceeds the maximum size
+var errRequestTooLarge = errors.New("request exceeds the maximum size")
+
+// sizeLimitedListener hands out connections on which requests larger than maxSize bytes, as
+// announced by their BER length, end the connection before any of their content is read.
+type sizeLimitedListener struct {
+	net.Listener
+	maxSize int
+	log     *zap.Logger
+}
+
+func (l sizeLimitedListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &sizeLimitedConn{Conn: conn, maxSize: l.maxSize, log: l.log}, nil
+}
+
+// sizeLimitedConn frames the client's stream one LDAPMessage at a time without buffering it:
+// the header is checked, then the content is handed out as it arrives
+type sizeLimitedConn struct {
+	net.Conn
+	maxSize   int
+	log       *zap.Logger
+	header    []byte // header of the current message, not handed out yet
+	remaining int    // content bytes of the current message not read yet
+}
+
+func (c *sizeLimitedConn) Read(p []byte) (int, error) {
+	if len(c.header) == 0 && c.remaining == 0 {
+		header, length, err := readMessageHeader(c.Conn)
+		if err != nil {
+			return 0, err
+		}
+		if length < 0 || length > c.maxSize {
+			return 0, c.refuse(length)
+		}
+		c.header, c.remaining = header, length
+	}
+	if len(c.header) > 0 {
+		n := copy(p, c.header)
+		c.header = c.header[n:]
+		return n, nil
+	}
+	if len(p) > c.remaining {
+		p = p[:c.remaining]
+	}
+	n, err := c.Conn.Read(p)
+	c.remaining -= n
+	return n, err
+}
+
+// refuse tells the client why its connection is closed, then closes it. The LDAP library
+// answers the requests of a connection one at a time, so nothing else is being written.
+func (c *sizeLimitedConn) refuse(length int) error {
+	stats.Frontend.Add("oversized_requests", 1)
+	message := fmt.Sprintf("request exceeds the maximum of %d bytes", c.maxSize)
+	c.log.Info("Request refused: too large", zap.String("src", c.RemoteAddr().String()), zap.Int("size", length), zap.Int("maxsize", c.maxSize))
+	if _, err := c.Conn.Write(encodeNoticeOfDisconnection(ldap.LDAPResultProtocolError, message)); err != nil {
+		c.log.Debug("Could not send notice of disconnection", zap.Error(err))
+	}
+	c.Conn.Close()
+	return errRequestTooLarge
+}
+
+// ConnectionState exposes the TLS state of the wrapped connection, for client certificate logging
+func (c *sizeLimitedConn) ConnectionState() tls.ConnectionState {
+	if tlsConn, ok := c.Conn.(interface{ ConnectionState() tls.ConnectionState }); ok {
+		return tlsConn.ConnectionState()
+	}
+	return tls.ConnectionState{}
+}
+
+// readMessageHeader reads the tag and length of the next LDAPMessage. The length is -1 when
+// it cannot be told, i.e. for indefinite lengths, which LDAP forbids, or overly long ones.
+func readMessageHeader(r io.Reader) ([]byte, int, error) {
+	header := make([]byte, 2, 6)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, 0, err
+	}
+	if header[1]&0x80 == 0 {
+		return header, int(header[1]), nil
+	}
+	size := int(header[1] & 0x7f)
+	if size == 0 || size > 4 {
+		return header, -1, nil
+	}
+	header = header[:2+size]
+	if _, err := io.ReadFull(r, header[2:]); err != nil {
+		return nil, 0, err
+	}
+	length := 0
+	for _, b := range header[2:] {
+		length = length<<8 | int(b)
+	}
+	return header, length, nil
+}
+
+// encodeNoticeOfDisconnection builds the unsolicited extended response sent before closing a connection
+func encodeNoticeOfDisconnection(resultCode ldap.LDAPResultCode, message string) []byte {
+	packet := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "LDAP Response")
+	packet.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, 0, "Message ID"))
+	response := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationExtendedResponse, nil, "Extended Response")
+	response.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, uint64(resultCode), "resultCode: "))
+	response.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "matchedDN: "))
+	response.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, message, "errorMessage: "))
+	response.AppendChild(ber.NewString(ber.ClassContext, ber.TypePrimitive, 10, noticeOfDisconnection, "responseName: "))
+	packet.AppendChild(response)
+	return packet.Bytes()
+}
@@ -1,13 +1,21 @@
 package server
 
 import (
+	"crypto/tls"
 	"errors"
 	"fmt"
+	"net"
+	"os"
+	"os/signal"
 	"plugin"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/GeertJohan/yubigo"
 	"github.com/etecs-ru/glauth/v2/pkg/config"
 	"github.com/etecs-ru/glauth/v2/pkg/handler"
+	"github.com/etecs-ru/glauth/v2/pkg/stats"
 	"github.com/nmcclain/ldap"
 	"go.uber.org/zap"
 )
@@ -17,6 +25,11 @@ type LdapSvc struct {
 	c        *config.Config
 	yubiAuth *yubigo.YubiAuth
 	l        *ldap.Server
+	statsd   *stats.StatsD
+	handlers handler.HandlerWrapper
+	frontend handler.Handler
+	lock     sync.Mutex // for running
+	running  int        // number of listeners currently serving
 }
 
 func NewServer(opts ...Option) (*LdapSvc, error) {
@@ -29,6 +42,13 @@ func NewServer(opts ...Option) (*LdapSvc, error) {
 
 	var err error
 
+	if err := s.c.CanonicalizeBaseDNs(); err != nil {
+		return nil, err
+	}
+	if err := s.c.ValidateOTPPolicies(); err != nil {
+		return nil, err
+	}
+
 	if len(s.c.YubikeyClientID) > 0 && len(s.c.YubikeySecret) > 0 {
 		s.yubiAuth, err = yubigo.NewYubiAuth(s.c.YubikeyClientID, s.c.YubikeySecret)
 
@@ -37,6 +57,22 @@ func NewServer(opts ...Option) (*LdapSvc, error) {
 		}
 	}
 
+	if s.c.LDAPS.Enabled {
+		if err := s.validateKeyPair("ldaps", s.c.LDAPS.Cert, s.c.LDAPS.Key); err != nil {
+			return nil, err
+		}
+		for i, c := range s.c.LDAPS.Certificates {
+			if err := s.validateKeyPair(fmt.Sprintf("ldaps%d", i+1), c.Cert, c.Key); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if s.c.API.Enabled && s.c.API.TLS {
+		if err := s.validateKeyPair("api", s.c.API.Cert, s.c.API.Key); err != nil {
+			return nil, err
+		}
+	}
+
 	var helper handler.Handler
 
 	loh := handler.NewLDAPOpsHelper()
@@ -74,7 +110,16 @@ func NewServer(opts ...Option) (*LdapSvc, error) {
 				handler.LDAPHelper(loh),
 			)
 		default:
-			return nil, fmt.Errorf("unsupported helper %s - must be one of 'config', 'plugin'", s.c.Helper.Datastore)
+			constructor, ok := registeredBackend(s.c.Helper.Datastore)
+			if !ok {
+				return nil, fmt.Errorf("unsupported helper %s - must be one of 'config', 'plugin' or a registered datastore", s.c.Helper.Datastore)
+			}
+			helper = constructor(
+				handler.Logger(s.log),
+				handler.Config(s.c),
+				handler.YubiAuth(s.yubiAuth),
+				handler.LDAPHelper(loh),
+			)
 		}
 		s.log.Info("Using helper", zap.String("datastore", s.c.Helper.Datastore))
 	}
@@ -84,7 +129,10 @@ func NewServer(opts ...Option) (*LdapSvc, error) {
 
 	// configure the backends
 	s.l = ldap.NewServer()
-	s.l.EnforceLDAP = true
+	// the filter, scope, requested attributes and size limit of searches, which the config
+	// backend relies on, are applied by handler.WithSearchChecks instead of the library;
+	// LDAPv2 binds are taken care of by the listener
+	s.l.EnforceLDAP = false
 	for i, backend := range s.c.Backends {
 		var h handler.Handler
 		switch backend.Datastore {
@@ -93,6 +141,7 @@ func NewServer(opts ...Option) (*LdapSvc, error) {
 				handler.Backend(backend),
 				handler.Handlers(allHandlers),
 				handler.Logger(s.log),
+				handler.Config(s.c),
 				handler.Helper(helper),
 			)
 		case "owncloud":
@@ -108,6 +157,18 @@ func NewServer(opts ...Option) (*LdapSvc, error) {
 				handler.YubiAuth(s.yubiAuth),
 				handler.LDAPHelper(loh),
 			)
+		case "memory":
+			h = handler.NewMemoryHandler(
+				handler.Backend(backend),
+				handler.Logger(s.log),
+				handler.Config(s.c),
+				handler.LDAPHelper(loh),
+			)
+		case "replay":
+			h = handler.NewReplayHandler(
+				handler.Backend(backend),
+				handler.Logger(s.log),
+			)
 		case "plugin":
 			plug, err := plugin.Open(backend.Plugin)
 			if err != nil {
@@ -132,42 +193,236 @@ func NewServer(opts ...Option) (*LdapSvc, error) {
 				handler.LDAPHelper(loh),
 			)
 		default:
-			return nil, fmt.Errorf("unsupported backend %s - must be one of 'config', 'ldap','owncloud' or 'plugin'", backend.Datastore)
+			constructor, ok := registeredBackend(backend.Datastore)
+			if !ok {
+				return nil, fmt.Errorf("unsupported backend %s - must be one of 'config', 'ldap', 'memory', 'owncloud', 'replay', 'plugin' or a registered datastore", backend.Datastore)
+			}
+			h = constructor(
+				handler.Backend(backend),
+				handler.Handlers(allHandlers),
+				handler.Logger(s.log),
+				handler.Config(s.c),
+				handler.YubiAuth(s.yubiAuth),
+				handler.Helper(helper),
+				handler.LDAPHelper(loh),
+			)
 		}
 		s.log.Info("Loading backend", zap.String("datastore", backend.Datastore), zap.Int("position", i))
 
-		// Only our first backend will answer proper LDAP queries.
-		// Note that this could evolve towars something nicer where we would maintain
-		// multiple binders in addition to the existing multiple LDAP backends
-		if i == 0 {
-			s.l.BindFunc("", h)
-			s.l.SearchFunc("", h)
-			s.l.CloseFunc("", h)
-		}
 		allHandlers.Handlers[i] = h
 		backendCounter++
 	}
+	s.handlers = allHandlers
+
+	// Only our first backend will answer proper LDAP queries, unless
+	// routes send some identities to other backends.
+	// Note that this could evolve towars something nicer where we would maintain
+	// multiple binders in addition to the existing multiple LDAP backends
+	if backendCounter >= 0 {
+		frontend := allHandlers.Handlers[0]
+		if len(s.c.Routing.Routes) > 0 || hasAuthBackendOverride(s.c.Users) || hasUPNSuffixes(s.c.Backends) {
+			frontend, err = handler.NewRoutingHandler(allHandlers, s.c, s.log)
+			if err != nil {
+				return nil, err
+			}
+			s.log.Info("Routing identities between backends", zap.Int("routes", len(s.c.Routing.Routes)), zap.Int("default", s.c.Routing.DefaultBackend))
+		}
+		frontend, err = handler.WithRootDSE(frontend, allHandlers, s.c, s.log)
+		if err != nil {
+			return nil, err
+		}
+		frontend = handler.WithSearchChecks(frontend, s.c.Behaviors.AlwaysReturned)
+		frontend = handler.WithEntryQuota(frontend, allHandlers, s.c, s.log)
+		ch := handler.WithContext(frontend)
+		ch = handler.WithFilterMetrics(ch, s.c.Behaviors.MaxFilterDepth, s.c.Behaviors.MaxFilterTerms)
+		if s.c.Behaviors.ReadOnly {
+			ch = handler.WithReadOnly(ch, s.c.Behaviors.ReadOnlyResultCode)
+			s.log.Info("Read-only mode: add, modify and delete requests will be refused")
+		}
+		if s.c.Behaviors.RecordFile != "" {
+			ch, err = handler.WithRecorder(ch, s.c.Behaviors.RecordFile, s.log)
+			if err != nil {
+				return nil, fmt.Errorf("unable to open recording file: %s", err)
+			}
+			s.log.Warn("Recording every operation and its response", zap.String("file", s.c.Behaviors.RecordFile))
+		}
+		ch = handler.WithConnectionSummary(ch, s.log)
+		ch = handler.WithRecovery(ch, s.log)
+		s.frontend = ch
+		s.l.BindFunc("", ch)
+		s.l.SearchFunc("", ch)
+		s.l.CloseFunc("", ch)
+		s.l.AddFunc("", ch)
+		s.l.ModifyFunc("", ch)
+		s.l.DeleteFunc("", ch)
+	}
+
+	if s.c.StatsD.Enabled {
+		s.statsd, err = stats.NewStatsD(s.c.StatsD.Network, s.c.StatsD.Address, s.c.StatsD.Prefix, s.c.StatsD.Tags, s.c.StatsD.FlushInterval*time.Second)
+		if err != nil {
+			return nil, fmt.Errorf("unable to set up statsd sink: %s", err)
+		}
+		go s.statsd.Run()
+		s.log.Info("Shipping stats to statsd", zap.String("address", s.c.StatsD.Address))
+	}
+
+	if s.c.Behaviors.MaintenanceSignal {
+		s.watchMaintenanceSignal()
+	}
 
 	return &s, nil
 }
 
-// ListenAndServe listens on the TCP network address s.c.LDAP.Listen
+// SetMaintenance enables or disables maintenance mode, in which new binds are refused
+func (s *LdapSvc) SetMaintenance(enabled bool) {
+	s.log.Info("Maintenance mode", zap.Bool("enabled", enabled))
+	handler.SetMaintenance(enabled)
+}
+
+// watchMaintenanceSignal toggles maintenance mode every time SIGUSR1 is received
+func (s *LdapSvc) watchMaintenanceSignal() {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGUSR1)
+	go func() {
+		for range sigs {
+			s.SetMaintenance(!handler.InMaintenance())
+		}
+	}()
+}
+
+// hasAuthBackendOverride tells whether some user must be authenticated by a given backend
+func hasAuthBackendOverride(users []config.User) bool {
+	for _, u := range users {
+		if u.AuthBackend != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// hasUPNSuffixes tells whether some backend serves the user@domain names of given domains
+func hasUPNSuffixes(backends []config.Backend) bool {
+	for _, b := range backends {
+		if len(b.UPNSuffixes) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// ListenAndServe listens on every TCP network address configured for s.c.LDAP
 func (s *LdapSvc) ListenAndServe() error {
-	s.log.Info("LDAP server listening", zap.String("address", s.c.LDAP.Listen))
-	return s.l.ListenAndServe(s.c.LDAP.Listen)
+	if s.c.Behaviors.AcceptLDAPv2 || s.c.LDAP.ReusePort || s.clientTimeouts() {
+		return s.serveAll("LDAP", s.c.LDAP.ListenAddresses(), func(address string) error {
+			ln, err := listen(address, s.c.LDAP.ReusePort)
+			if err != nil {
+				return err
+			}
+			return s.serve(ln)
+		})
+	}
+	return s.serveAll("LDAP", s.c.LDAP.ListenAddresses(), func(address string) error {
+		return s.l.ListenAndServe(address)
+	})
 }
 
-// ListenAndServeTLS listens on the TCP network address s.c.LDAPS.Listen
+// ListenAndServeTLS listens on every TCP network address configured for s.c.LDAPS
 func (s *LdapSvc) ListenAndServeTLS() error {
-	s.log.Info("LDAPS server listening", zap.String("address", s.c.LDAPS.Listen))
-	return s.l.ListenAndServeTLS(
-		s.c.LDAPS.Listen,
-		s.c.LDAPS.Cert,
-		s.c.LDAPS.Key,
-	)
+	if s.c.LDAPS.ClientCA != "" || s.c.Behaviors.AcceptLDAPv2 || s.c.LDAPS.ReusePort || len(s.c.LDAPS.Certificates) > 0 || s.clientTimeouts() {
+		var tlsConfig *tls.Config
+		var err error
+		if s.c.LDAPS.ClientCA != "" {
+			tlsConfig, err = mutualTLSConfig(s.c.LDAPS.Cert, s.c.LDAPS.Key, s.c.LDAPS.Certificates, s.c.LDAPS.ClientCA)
+		} else {
+			tlsConfig, err = serverTLSConfig(s.c.LDAPS.Cert, s.c.LDAPS.Key, s.c.LDAPS.Certificates)
+		}
+		if err != nil {
+			return err
+		}
+		return s.serveAll("LDAPS", s.c.LDAPS.ListenAddresses(), func(address string) error {
+			ln, err := listen(address, s.c.LDAPS.ReusePort)
+			if err != nil {
+				return err
+			}
+			return s.serve(tls.NewListener(ln, tlsConfig))
+		})
+	}
+	return s.serveAll("LDAPS", s.c.LDAPS.ListenAddresses(), func(address string) error {
+		return s.l.ListenAndServeTLS(
+			address,
+			s.c.LDAPS.Cert,
+			s.c.LDAPS.Key,
+		)
+	})
+}
+
+// serve answers the connections accepted by ln, through the LDAPv2 shim when enabled,
+// dropping clients that send oversized requests or outwait the configured timeouts
+func (s *LdapSvc) serve(ln net.Listener) error {
+	if s.c.Behaviors.MaxRequestSize > 0 {
+		ln = sizeLimitedListener{Listener: ln, maxSize: s.c.Behaviors.MaxRequestSize, log: s.log}
+	}
+	if s.c.Behaviors.AcceptLDAPv2 {
+		ln = ldapv2Listener{Listener: ln}
+	}
+	if s.clientTimeouts() {
+		ln = deadlineListener{
+			Listener: ln,
+			read:     s.c.Behaviors.ClientReadTimeout * time.Second,
+			write:    s.c.Behaviors.ClientWriteTimeout * time.Second,
+		}
+	}
+	return s.l.Serve(ln)
 }
 
-// Shutdown ends listeners by sending true to the ldap serves quit channel
+// clientTimeouts tells whether silent clients are to be dropped
+func (s *LdapSvc) clientTimeouts() bool {
+	return s.c.Behaviors.ClientReadTimeout > 0 || s.c.Behaviors.ClientWriteTimeout > 0
+}
+
+// serveAll starts one listener per address and returns as soon as one of them fails,
+// or once all of them have been shut down
+func (s *LdapSvc) serveAll(protocol string, addresses []string, serve func(address string) error) error {
+	if len(addresses) == 0 {
+		return fmt.Errorf("no listen address configured for %s", protocol)
+	}
+	errs := make(chan error, len(addresses))
+	for _, address := range addresses {
+		s.log.Info(protocol+" server listening", zap.String("address", address))
+		s.lock.Lock()
+		s.running++
+		s.lock.Unlock()
+		go func(address string) {
+			err := serve(address)
+			s.lock.Lock()
+			s.running--
+			s.lock.Unlock()
+			errs <- err
+		}(address)
+	}
+	for range addresses {
+		if err := <-errs; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Shutdown ends listeners by sending true to the ldap serves quit channel, once per running listener
 func (s *LdapSvc) Shutdown() {
-	s.l.Quit <- true
+	s.lock.Lock()
+	running := s.running
+	s.lock.Unlock()
+	for i := 0; i < running; i++ {
+		s.l.Quit <- true
+	}
+	handler.StopFailureDelays()
+	if s.statsd != nil {
+		s.statsd.Stop()
+	}
+	for i := 0; i <= *s.handlers.Count; i++ {
+		if stopper, ok := s.handlers.Handlers[i].(handler.Stopper); ok {
+			stopper.Stop()
+		}
+	}
 }
@@ -0,0 +1,126 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"expvar"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/etecs-ru/glauth/v2/pkg/config"
+	"github.com/etecs-ru/glauth/v2/pkg/stats"
+	"go.uber.org/zap"
+)
+
+// validateKeyPair loads and parses a certificate/key pair so that configuration
+// mistakes are reported before any listener is started
+func (s *LdapSvc) validateKeyPair(name, certFile, keyFile string) error {
+	for _, f := range []string{certFile, keyFile} {
+		if _, err := os.Stat(f); err != nil {
+			return fmt.Errorf("%s: unable to read %s: %s", name, f, err)
+		}
+	}
+	pair, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return fmt.Errorf("%s: invalid certificate/key pair: %s", name, err)
+	}
+	if len(pair.Certificate) == 0 {
+		return fmt.Errorf("%s: no certificate found in %s", name, certFile)
+	}
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return fmt.Errorf("%s: unable to parse certificate: %s", name, err)
+	}
+
+	s.log.Info("TLS certificate loaded",
+		zap.String("listener", name),
+		zap.String("subject", cert.Subject.String()),
+		zap.Time("notafter", cert.NotAfter))
+	if time.Now().After(cert.NotAfter) {
+		s.log.Warn("TLS certificate has expired", zap.String("listener", name), zap.Time("notafter", cert.NotAfter))
+	}
+	expiry := new(expvar.Int)
+	expiry.Set(cert.NotAfter.Unix())
+	stats.General.Set(name+"_cert_expiry", expiry)
+	return nil
+}
+
+// serverTLSConfig returns the LDAPS settings presenting the certificate of certFile, or one of
+// the additional certificates when it names the host the client asks for through SNI
+func serverTLSConfig(certFile, keyFile string, additional []config.TLSCertificate) (*tls.Config, error) {
+	pair, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("ldaps: invalid certificate/key pair: %s", err)
+	}
+	if len(additional) == 0 {
+		return &tls.Config{Certificates: []tls.Certificate{pair}}, nil
+	}
+	sni := sniCertificates{fallback: &pair, names: make(map[string]*tls.Certificate)}
+	for _, c := range additional {
+		pair, err := tls.LoadX509KeyPair(c.Cert, c.Key)
+		if err != nil {
+			return nil, fmt.Errorf("ldaps: invalid certificate/key pair %s: %s", c.Cert, err)
+		}
+		leaf, err := x509.ParseCertificate(pair.Certificate[0])
+		if err != nil {
+			return nil, fmt.Errorf("ldaps: unable to parse certificate %s: %s", c.Cert, err)
+		}
+		names := leaf.DNSNames
+		if len(names) == 0 && leaf.Subject.CommonName != "" {
+			names = []string{leaf.Subject.CommonName}
+		}
+		for _, name := range names {
+			// the first certificate listed for a name wins
+			if _, ok := sni.names[strings.ToLower(name)]; !ok {
+				sni.names[strings.ToLower(name)] = &pair
+			}
+		}
+	}
+	return &tls.Config{GetCertificate: sni.get}, nil
+}
+
+// sniCertificates maps host names, wildcards included, to the certificate presented for them
+type sniCertificates struct {
+	fallback *tls.Certificate
+	names    map[string]*tls.Certificate
+}
+
+// get picks the certificate of the host name the client asks for, the default one when the
+// client asks for none, or for a host no additional certificate names
+func (c sniCertificates) get(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	name := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+	if name == "" {
+		return c.fallback, nil
+	}
+	if cert, ok := c.names[name]; ok {
+		return cert, nil
+	}
+	if i := strings.Index(name, "."); i > 0 {
+		if cert, ok := c.names["*"+name[i:]]; ok {
+			return cert, nil
+		}
+	}
+	return c.fallback, nil
+}
+
+// mutualTLSConfig returns the LDAPS settings verifying the client certificates issued
+// by the CAs of caFile. Clients without a certificate are still accepted.
+func mutualTLSConfig(certFile, keyFile string, additional []config.TLSCertificate, caFile string) (*tls.Config, error) {
+	tlsConfig, err := serverTLSConfig(certFile, keyFile, additional)
+	if err != nil {
+		return nil, err
+	}
+	pem, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("ldaps: unable to read %s: %s", caFile, err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("ldaps: no CA certificate found in %s", caFile)
+	}
+	tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	tlsConfig.ClientCAs = pool
+	return tlsConfig, nil
+}
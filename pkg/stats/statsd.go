@@ -0,0 +1,137 @@
+package stats
+
+import (
+	"expvar"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxPacketSize keeps a batch of metrics within a single UDP datagram on most networks
+const maxPacketSize = 1432
+
+// StatsD periodically ships the exposed expvar counters to a StatsD or DogStatsD agent
+type StatsD struct {
+	conn     net.Conn
+	network  string
+	prefix   string
+	tags     string
+	interval time.Duration
+	last     map[string]int64
+	quit     chan struct{}
+	once     sync.Once
+}
+
+// NewStatsD connects to the agent at address over network ("udp" or "tcp").
+// Tags, in "key:value" form, are appended using the DogStatsD syntax.
+func NewStatsD(network, address, prefix string, tags []string, interval time.Duration) (*StatsD, error) {
+	if network == "" {
+		network = "udp"
+	}
+	if network != "udp" && network != "tcp" {
+		return nil, fmt.Errorf("unsupported statsd network %s - must be one of 'udp', 'tcp'", network)
+	}
+	if interval <= 0 {
+		interval = 10 * time.Second
+	}
+	conn, err := net.Dial(network, address)
+	if err != nil {
+		return nil, err
+	}
+	s := &StatsD{
+		conn:     conn,
+		network:  network,
+		prefix:   prefix,
+		interval: interval,
+		last:     make(map[string]int64),
+		quit:     make(chan struct{}),
+	}
+	if len(tags) > 0 {
+		s.tags = "|#" + strings.Join(tags, ",")
+	}
+	return s, nil
+}
+
+// Run flushes metrics every interval until Stop is called
+func (s *StatsD) Run() {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.Flush()
+		case <-s.quit:
+			s.Flush()
+			s.conn.Close()
+			return
+		}
+	}
+}
+
+// Stop flushes pending metrics and closes the connection to the agent
+func (s *StatsD) Stop() {
+	s.once.Do(func() { close(s.quit) })
+}
+
+// Flush sends counters as deltas since the previous flush, and gauges as their current value
+func (s *StatsD) Flush() error {
+	var lines []string
+	for name, m := range map[string]*expvar.Map{"frontend": Frontend, "backend": Backend, "general": General} {
+		m.Do(func(kv expvar.KeyValue) {
+			iv, ok := kv.Value.(*expvar.Int)
+			if !ok {
+				return
+			}
+			key := name + "." + kv.Key
+			if s.prefix != "" {
+				key = s.prefix + "." + key
+			}
+			value := iv.Value()
+			if isGauge(kv.Key) {
+				lines = append(lines, fmt.Sprintf("%s:%d|g%s", key, value, s.tags))
+				return
+			}
+			delta := value - s.last[key]
+			s.last[key] = value
+			if delta != 0 {
+				lines = append(lines, fmt.Sprintf("%s:%d|c%s", key, delta, s.tags))
+			}
+		})
+	}
+	return s.send(lines)
+}
+
+// send batches lines into packets no larger than maxPacketSize
+func (s *StatsD) send(lines []string) error {
+	var batch strings.Builder
+	for _, line := range lines {
+		if batch.Len() > 0 && batch.Len()+len(line)+1 > maxPacketSize {
+			if err := s.write(batch.String()); err != nil {
+				return err
+			}
+			batch.Reset()
+		}
+		if batch.Len() > 0 {
+			batch.WriteByte('\n')
+		}
+		batch.WriteString(line)
+	}
+	if batch.Len() > 0 {
+		return s.write(batch.String())
+	}
+	return nil
+}
+
+func (s *StatsD) write(packet string) error {
+	if s.network == "tcp" {
+		packet += "\n"
+	}
+	_, err := s.conn.Write([]byte(packet))
+	return err
+}
+
+func isGauge(key string) bool {
+	return strings.HasSuffix(key, "_live") || strings.HasSuffix(key, "_expiry")
+}